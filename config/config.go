@@ -0,0 +1,359 @@
+// Package config reads the declarative configuration file of the proxy.
+//
+// The file is a JSON object, or a YAML mapping if its name ends in .yaml or
+// .yml. Its keys are flag names, e.g. "uaa.url", with string, number, boolean
+// or string list values. The special keys "routes" and "policy" hold a routing
+// table and an authorization policy in the format of the routes and policy
+// files.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/st3v/uaa-proxy/router"
+	"github.com/st3v/uaa-proxy/uaa"
+)
+
+// File is a parsed configuration file.
+type File struct {
+	Path     string
+	Settings []Setting
+
+	// nil unless given in the file
+	Routes []router.Route
+	Policy *uaa.Policy
+}
+
+// Setting is the value of a flag given in a configuration file.
+type Setting struct {
+	Name  string
+	Value string
+	Line  int
+}
+
+// Error is an error at a line of a configuration file.
+type Error struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+// Load reads and validates a configuration file.
+func Load(file string) (*File, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(file, data)
+}
+
+// Parse validates the configuration read from the given file. Unknown fields,
+// duplicate keys and invalid routes or rules are rejected.
+func Parse(file string, data []byte) (*File, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		var err error
+		if data, err = yamlToJSON(file, data); err != nil {
+			return nil, err
+		}
+	}
+
+	p := newParser(file, data)
+	f := &File{Path: file}
+	seen := map[string]bool{}
+
+	err := p.object(func(key string, off int64) error {
+		if seen[key] {
+			return p.errorf(off, "duplicate key %q", key)
+		}
+		seen[key] = true
+
+		switch key {
+		case "routes":
+			return p.routes(f)
+		case "policy":
+			return p.policy(f)
+		}
+
+		value, err := p.setting()
+		if err != nil {
+			return err
+		}
+
+		f.Settings = append(f.Settings, Setting{Name: key, Value: value, Line: p.line(off)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if off := p.next(); off < int64(len(data)) {
+		return nil, p.errorf(off, "unexpected data after configuration")
+	}
+
+	return f, nil
+}
+
+// Apply sets the flags given in the file. Flags already set, e.g. on the
+// command line, take precedence.
+func (f *File) Apply(flags *flag.FlagSet) error {
+	set := map[string]bool{}
+	flags.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+
+	for _, s := range f.Settings {
+		if flags.Lookup(s.Name) == nil {
+			return &Error{f.Path, s.Line, fmt.Errorf("unknown setting %q", s.Name)}
+		}
+
+		if set[s.Name] {
+			continue
+		}
+
+		if err := flags.Set(s.Name, s.Value); err != nil {
+			return &Error{f.Path, s.Line, fmt.Errorf("invalid value %q for %s: %v", s.Value, s.Name, err)}
+		}
+	}
+
+	return nil
+}
+
+// Changed returns the names of settings that differ between the files.
+func (f *File) Changed(other *File) []string {
+	values := map[string]string{}
+	for _, s := range f.Settings {
+		values[s.Name] = s.Value
+	}
+
+	changed := []string{}
+	for _, s := range other.Settings {
+		if v, ok := values[s.Name]; !ok || v != s.Value {
+			changed = append(changed, s.Name)
+		}
+		delete(values, s.Name)
+	}
+
+	for _, s := range f.Settings {
+		if _, ok := values[s.Name]; ok {
+			changed = append(changed, s.Name)
+		}
+	}
+
+	return changed
+}
+
+func (p *parser) routes(f *File) error {
+	f.Routes = []router.Route{}
+
+	return p.array(func(off int64) error {
+		var route router.Route
+		if err := p.decode(&route); err != nil {
+			return err
+		}
+
+		if err := route.Validate(); err != nil {
+			return p.errorf(off, "route %d: %v", len(f.Routes), err)
+		}
+
+		f.Routes = append(f.Routes, route)
+		return nil
+	})
+}
+
+func (p *parser) policy(f *File) error {
+	f.Policy = new(uaa.Policy)
+
+	return p.object(func(key string, off int64) error {
+		if key != "rules" {
+			return p.errorf(off, "unknown field %q in policy", key)
+		}
+
+		return p.array(func(off int64) error {
+			var rule uaa.Rule
+			if err := p.decode(&rule); err != nil {
+				return err
+			}
+
+			if err := (&uaa.Policy{Rules: []uaa.Rule{rule}}).Validate(); err != nil {
+				// report the index within the policy
+				msg := strings.TrimPrefix(err.Error(), "rule 0: ")
+				return p.errorf(off, "rule %d: %s", len(f.Policy.Rules), msg)
+			}
+
+			f.Policy.Rules = append(f.Policy.Rules, rule)
+			return nil
+		})
+	})
+}
+
+// setting decodes the value of a flag.
+func (p *parser) setting() (string, error) {
+	off := p.next()
+
+	var v interface{}
+	if err := p.dec.Decode(&v); err != nil {
+		return "", p.wrap(off, err)
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		values := []string{}
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return "", p.errorf(off, "lists may only contain strings")
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, ","), nil
+	}
+
+	return "", p.errorf(off, "value must be a string, number, boolean or list of strings")
+}
+
+// parser walks the JSON tokens of a file keeping track of offsets.
+type parser struct {
+	file string
+	data []byte
+	dec  *json.Decoder
+}
+
+func newParser(file string, data []byte) *parser {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return &parser{file: file, data: data, dec: dec}
+}
+
+// object calls fn for every key of the next object, fn has to consume the
+// value.
+func (p *parser) object(fn func(key string, off int64) error) error {
+	if err := p.delim('{'); err != nil {
+		return err
+	}
+
+	for p.dec.More() {
+		off := p.next()
+		tok, err := p.dec.Token()
+		if err != nil {
+			return p.wrap(off, err)
+		}
+
+		if err := fn(tok.(string), off); err != nil {
+			return err
+		}
+	}
+
+	return p.delim('}')
+}
+
+// array calls fn for every element of the next array, fn has to consume the
+// element.
+func (p *parser) array(fn func(off int64) error) error {
+	if err := p.delim('['); err != nil {
+		return err
+	}
+
+	for p.dec.More() {
+		if err := fn(p.next()); err != nil {
+			return err
+		}
+	}
+
+	return p.delim(']')
+}
+
+func (p *parser) delim(want json.Delim) error {
+	off := p.next()
+	tok, err := p.dec.Token()
+	if err == io.EOF {
+		return p.errorf(off, "unexpected end of file")
+	}
+	if err != nil {
+		return p.wrap(off, err)
+	}
+
+	if tok != want {
+		return p.errorf(off, "expected %q", want.String())
+	}
+
+	return nil
+}
+
+// decode strictly decodes the next value into v.
+func (p *parser) decode(v interface{}) error {
+	off := p.next()
+
+	var raw json.RawMessage
+	if err := p.dec.Decode(&raw); err != nil {
+		return p.wrap(off, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	if e, ok := err.(*json.UnmarshalTypeError); ok {
+		return p.errorf(off+e.Offset, "field %s must be of type %s", e.Field, e.Type)
+	}
+
+	// point at the unknown field
+	msg := strings.TrimPrefix(err.Error(), "json: ")
+	if name := strings.TrimPrefix(msg, "unknown field "); name != msg {
+		if i := bytes.Index(raw, []byte(name)); i >= 0 {
+			off += int64(i)
+		}
+	}
+
+	return p.errorf(off, "%s", msg)
+}
+
+// next returns the offset of the next token.
+func (p *parser) next() int64 {
+	off := p.dec.InputOffset()
+	for off < int64(len(p.data)) && strings.IndexByte(" \t\r\n,:", p.data[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+func (p *parser) line(off int64) int {
+	if off > int64(len(p.data)) {
+		off = int64(len(p.data))
+	}
+	return bytes.Count(p.data[:off], []byte("\n")) + 1
+}
+
+func (p *parser) errorf(off int64, format string, args ...interface{}) error {
+	return &Error{p.file, p.line(off), fmt.Errorf(format, args...)}
+}
+
+// wrap adds the line to a decoding error, syntax errors know their offset.
+func (p *parser) wrap(off int64, err error) error {
+	if e, ok := err.(*json.SyntaxError); ok {
+		off = e.Offset
+	}
+	return p.errorf(off, "%s", strings.TrimPrefix(err.Error(), "json: "))
+}
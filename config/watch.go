@@ -0,0 +1,53 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/st3v/uaa-proxy/logging"
+)
+
+// Watch checks the given files for changes every interval and signals them
+// on the returned channel.
+func Watch(interval time.Duration, files ...string) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		last := stat(files)
+
+		for range time.Tick(interval) {
+			current := stat(files)
+			if current == last {
+				continue
+			}
+			last = current
+
+			logging.Debug("configuration files changed", "files", files)
+
+			// a pending change covers this one
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changes
+}
+
+// stat returns a fingerprint of the modification times and sizes of files.
+func stat(files []string) string {
+	var b []byte
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			b = append(b, '-')
+			continue
+		}
+		b = info.ModTime().AppendFormat(b, time.RFC3339Nano)
+		b = strconv.AppendInt(append(b, ' '), info.Size(), 10)
+		b = append(b, '|')
+	}
+	return string(b)
+}
@@ -0,0 +1,198 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maximum number of nodes a YAML document may expand to through aliases
+const maxYAMLNodes = 100000
+
+var (
+	yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+	jsonNumber    = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+)
+
+// yamlToJSON converts a YAML document holding a mapping to JSON. Every key
+// and value is kept on its original line, so that errors found when parsing
+// the JSON refer to the right line.
+func yamlToJSON(file string, data []byte) ([]byte, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+
+	var doc yaml.Node
+	switch err := dec.Decode(&doc); err {
+	case nil:
+	case io.EOF:
+		return []byte("{}"), nil
+	default:
+		return nil, yamlError(file, err)
+	}
+
+	var next yaml.Node
+	switch err := dec.Decode(&next); err {
+	case io.EOF:
+	case nil:
+		return nil, &Error{file, next.Line, errors.New("multiple documents are not supported")}
+	default:
+		return nil, yamlError(file, err)
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, &Error{file, root.Line, errors.New("configuration must be a mapping")}
+	}
+
+	w := &yamlWriter{file: file, line: 1}
+	if err := w.node(root); err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// yamlError adds the file to a YAML error, keeping its line if known.
+func yamlError(file string, err error) error {
+	if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return &Error{file, line, errors.New(m[2])}
+	}
+	return fmt.Errorf("%s: %v", file, err)
+}
+
+// yamlWriter writes nodes as JSON, starting every node on its line.
+type yamlWriter struct {
+	file  string
+	buf   bytes.Buffer
+	line  int
+	nodes int
+
+	// aliases being expanded
+	expanding []*yaml.Node
+}
+
+func (w *yamlWriter) at(line int) {
+	for ; w.line < line; w.line++ {
+		w.buf.WriteByte('\n')
+	}
+}
+
+func (w *yamlWriter) node(n *yaml.Node) error {
+	if w.nodes++; w.nodes > maxYAMLNodes {
+		return &Error{w.file, n.Line, errors.New("document too large")}
+	}
+
+	w.at(n.Line)
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+
+			if key.Kind != yaml.ScalarNode {
+				return &Error{w.file, key.Line, errors.New("keys must be scalars")}
+			}
+			if key.Tag == "!!merge" {
+				return &Error{w.file, key.Line, errors.New("merge keys are not supported")}
+			}
+
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			w.at(key.Line)
+			w.buf.WriteString(jsonString(key.Value))
+			w.buf.WriteByte(':')
+
+			if err := w.node(value); err != nil {
+				return err
+			}
+		}
+		w.buf.WriteByte('}')
+
+	case yaml.SequenceNode:
+		w.buf.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			if err := w.node(item); err != nil {
+				return err
+			}
+		}
+		w.buf.WriteByte(']')
+
+	case yaml.AliasNode:
+		for _, a := range w.expanding {
+			if a == n.Alias {
+				return &Error{w.file, n.Line, fmt.Errorf("alias %q refers to itself", n.Value)}
+			}
+		}
+
+		w.expanding = append(w.expanding, n.Alias)
+		defer func() { w.expanding = w.expanding[:len(w.expanding)-1] }()
+
+		// the anchored node comes earlier, keep writing on this line
+		alias := *n.Alias
+		alias.Line = n.Line
+		return w.node(&alias)
+
+	case yaml.ScalarNode:
+		s, err := scalarJSON(n)
+		if err != nil {
+			return &Error{w.file, n.Line, err}
+		}
+		w.buf.WriteString(s)
+
+	default:
+		return &Error{w.file, n.Line, errors.New("unexpected document")}
+	}
+
+	return nil
+}
+
+// scalarJSON returns a scalar as JSON value of its resolved type. Numbers keep
+// their notation where JSON allows it.
+func scalarJSON(n *yaml.Node) (string, error) {
+	switch n.ShortTag() {
+	case "!!null":
+		return "null", nil
+
+	case "!!bool":
+		var v bool
+		if err := n.Decode(&v); err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(v), nil
+
+	case "!!int", "!!float":
+		if jsonNumber.MatchString(n.Value) {
+			return n.Value, nil
+		}
+
+		var v float64
+		if err := n.Decode(&v); err != nil {
+			return "", err
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", fmt.Errorf("number %s not supported", n.Value)
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+
+	case "!!str", "!!timestamp", "!!binary":
+		return jsonString(n.Value), nil
+	}
+
+	return "", fmt.Errorf("unsupported tag %s", n.Tag)
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestYAMLToJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"empty", "# nothing\n", `{}`},
+		{"scalars", "a: 1\nb: 1.50\nc: true\nd: ~\ne: text\nf: '007'\ng: 0x1F\nh: +1\n", `{"a":1,"b":1.50,"c":true,"d":null,"e":"text","f":"007","g":31,"h":1}`},
+		{"quoted", "a: \"x: y # z\"\nb: 'it''s'\nc: \"tab\\t\"\n", `{"a":"x: y # z","b":"it's","c":"tab\t"}`},
+		{"comments", "---\na: b # comment\n# full line\nc: http://host/#anchor\n", `{"a":"b","c":"http://host/#anchor"}`},
+		{"nested mapping", "a:\n  b:\n    c: 1\n  d: 2\ne: 3\n", `{"a":{"b":{"c":1},"d":2},"e":3}`},
+		{"sequence", "a:\n  - x\n  - y\nb:\n- z\n", `{"a":["x","y"],"b":["z"]}`},
+		{"sequence of mappings", "r:\n  - name: a\n    ports: [1, 2]\n  -\n    name: b\n  - - nested\n", `{"r":[{"name":"a","ports":[1,2]},{"name":"b"},["nested"]]}`},
+		{"flow collections", "a: [x, 'y', {k: v, e: }, []]\nb: {}\n", `{"a":["x","y",{"k":"v","e":null},[]],"b":{}}`},
+		{"block scalar", "a: |\n  line 1\n  line 2\nb: 1\n", `{"a":"line 1\nline 2\n","b":1}`},
+		{"anchors", "a: &scopes [x, y]\nb: *scopes\n", `{"a":["x","y"],"b":["x","y"]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := yamlToJSON("test.yml", []byte(tt.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// compare ignoring the newlines keeping values on their lines
+			compact := strings.Replace(string(got), "\n", "", -1)
+			if compact != tt.want {
+				t.Errorf("got %s, want %s", compact, tt.want)
+			}
+
+			if !json.Valid(got) {
+				t.Errorf("invalid JSON %s", got)
+			}
+		})
+	}
+}
+
+func TestYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"bad indentation", "a: 1\n  b: 2\n", "test.yml:2: "},
+		{"tab indentation", "a:\n\tb: 2\n", "test.yml:2: "},
+		{"missing colon", "a: 1\nb\nc: 2\n", "test.yml:2: "},
+		{"not a mapping", "\n- a\n", "test.yml:2: configuration must be a mapping"},
+		{"multiple documents", "a: 1\n---\nb: 2\n", "test.yml:2: multiple documents are not supported"},
+		{"merge key", "a: &x {b: 1}\nc:\n  <<: *x\n", "test.yml:3: merge keys are not supported"},
+		{"complex key", "? [a]\n: 1\n", "test.yml:1: keys must be scalars"},
+		{"custom tag", "a: 1\nb: !secret x\n", "test.yml:2: unsupported tag !secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := yamlToJSON("test.yml", []byte(tt.yaml))
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	yaml := `# proxy settings
+uaa.url: https://uaa.example.com
+uaa.scopes: [openid, "app.read"]
+session.max-age: 3600
+bearer.enabled: true
+
+routes:
+  - name: api
+    path_prefix: /api
+    backends:
+      - http://10.0.0.1:8080
+      - http://10.0.0.2:8080
+    max_fails: 3
+    eject_duration: 30s
+
+policy:
+  rules:
+    - path: /admin/**
+      scopes: [app.admin]
+`
+
+	f, err := Parse("proxy.yaml", []byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := []Setting{
+		{"uaa.url", "https://uaa.example.com", 2},
+		{"uaa.scopes", "openid,app.read", 3},
+		{"session.max-age", "3600", 4},
+		{"bearer.enabled", "true", 5},
+	}
+	if !reflect.DeepEqual(f.Settings, settings) {
+		t.Errorf("settings: got %+v, want %+v", f.Settings, settings)
+	}
+
+	if len(f.Routes) != 1 || f.Routes[0].Name != "api" || len(f.Routes[0].Backends) != 2 || f.Routes[0].MaxFails != 3 {
+		t.Errorf("routes: got %+v", f.Routes)
+	}
+
+	if f.Policy == nil || len(f.Policy.Rules) != 1 || f.Policy.Rules[0].Path != "/admin/**" {
+		t.Errorf("policy: got %+v", f.Policy)
+	}
+}
+
+func TestParseYAMLErrorLines(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{
+			"duplicate key",
+			"uaa.url: a\n\nuaa.url: b\n",
+			`proxy.yml:3: duplicate key "uaa.url"`,
+		},
+		{
+			"invalid setting value",
+			"uaa.url: a\nuaa.scopes: [a, [b]]\n",
+			"proxy.yml:2: lists may only contain strings",
+		},
+		{
+			"unknown route field",
+			"routes:\n  - name: a\n    backend: http://b\n    bakends: []\n",
+			`proxy.yml:4: unknown field "bakends"`,
+		},
+		{
+			"route field type",
+			"routes:\n  - name: a\n    backend: http://b\n    max_fails: many\n",
+			"proxy.yml:4: field max_fails must be of type int",
+		},
+		{
+			"invalid route",
+			"routes:\n  - name: a\n  - name: b\n    backend: http://b\n",
+			"proxy.yml:2: route 0: ",
+		},
+		{
+			"unknown policy field",
+			"policy:\n  rules: []\n  extra: 1\n",
+			`proxy.yml:3: unknown field "extra" in policy`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse("proxy.yml", []byte(tt.yaml))
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
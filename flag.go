@@ -2,7 +2,6 @@ package main
 
 import (
 	"flag"
-	"log"
 	"os"
 	"strconv"
 	"strings"
@@ -10,8 +9,6 @@ import (
 )
 
 func init() {
-	log.SetFlags(0)
-
 	flag.StringVar(
 		&listenAddr,
 		"listen",
@@ -19,11 +16,137 @@ func init() {
 		"address to listen on [LISTEN_ADDRESS]",
 	)
 
+	flag.StringVar(
+		&configFile,
+		"config.file",
+		getEnvString("CONFIG_FILE", ""),
+		"path to JSON or YAML (.yaml, .yml) config file holding settings keyed by flag name as well as routes and policy, command line flags take precedence; reloads only apply routes and policy, changed settings are logged and need a restart [CONFIG_FILE]",
+	)
+
+	flag.DurationVar(
+		&configWatchInterval,
+		"config.watch-interval",
+		getEnvDuration("CONFIG_WATCH_INTERVAL", 10*time.Second),
+		"interval to check config, routes and policy files for changes and reload routes and policy, 0 to only reload on SIGHUP [CONFIG_WATCH_INTERVAL]",
+	)
+
+	flag.StringVar(
+		&adminListen,
+		"admin.listen",
+		getEnvString("ADMIN_LISTEN_ADDRESS", ""),
+		"optional address of the admin listener serving /metrics, /healthz and /readyz [ADMIN_LISTEN_ADDRESS]",
+	)
+
+	flag.StringVar(
+		&logFormat,
+		"log.format",
+		getEnvString("LOG_FORMAT", "logfmt"),
+		"log format, either logfmt or json [LOG_FORMAT]",
+	)
+
+	flag.StringVar(
+		&logLevel,
+		"log.level",
+		getEnvString("LOG_LEVEL", "info"),
+		"minimum log level, one of debug, info, warn or error [LOG_LEVEL]",
+	)
+
+	flag.BoolVar(
+		&logAccess,
+		"log.access",
+		getEnvBool("LOG_ACCESS", true),
+		"write an access log record per request [LOG_ACCESS]",
+	)
+
+	flag.StringVar(
+		&healthLivenessPath,
+		"health.liveness-path",
+		getEnvString("HEALTH_LIVENESS_PATH", "/healthz"),
+		"unauthenticated path reporting whether the proxy is alive, empty to disable [HEALTH_LIVENESS_PATH]",
+	)
+
+	flag.StringVar(
+		&healthReadinessPath,
+		"health.readiness-path",
+		getEnvString("HEALTH_READINESS_PATH", "/readyz"),
+		"unauthenticated path reporting whether UAA and the backend are reachable, details of failed checks are only served on the admin listener, empty to disable [HEALTH_READINESS_PATH]",
+	)
+
+	flag.StringVar(
+		&healthUAAPath,
+		"health.uaa-path",
+		getEnvString("HEALTH_UAA_PATH", "/healthz"),
+		"UAA path probed by the readiness check, e.g. /healthz or /token_keys [HEALTH_UAA_PATH]",
+	)
+
+	flag.DurationVar(
+		&healthCacheTTL,
+		"health.cache-ttl",
+		getEnvDuration("HEALTH_CACHE_TTL", 5*time.Second),
+		"time to cache readiness results [HEALTH_CACHE_TTL]",
+	)
+
+	flag.DurationVar(
+		&healthTimeout,
+		"health.timeout",
+		getEnvDuration("HEALTH_TIMEOUT", 3*time.Second),
+		"timeout of the readiness checks [HEALTH_TIMEOUT]",
+	)
+
+	flag.DurationVar(
+		&shutdownTimeout,
+		"shutdown-timeout",
+		getEnvDuration("SHUTDOWN_TIMEOUT", 10*time.Second),
+		"time to drain requests and websocket connections after SIGTERM before closing them [SHUTDOWN_TIMEOUT]",
+	)
+
 	flag.StringVar(
 		&backendAddr,
 		"backend",
 		getEnvString("BACKEND_ADDRESS", ""),
-		"backend address [BACKEND_ADDRESS]",
+		"backend address, ignored if a routes file is given [BACKEND_ADDRESS]",
+	)
+
+	flag.StringVar(
+		&routesFile,
+		"routes.file",
+		getEnvString("ROUTES_FILE", ""),
+		"path to JSON file mapping hosts and path prefixes to backends [ROUTES_FILE]",
+	)
+
+	flag.StringVar(
+		&backendCACertPath,
+		"backend.ca-cert",
+		getEnvString("BACKEND_CA_CERT", ""),
+		"path to CA cert for HTTPS backends [BACKEND_CA_CERT]",
+	)
+
+	flag.StringVar(
+		&backendClientCert,
+		"backend.client-cert",
+		getEnvString("BACKEND_CLIENT_CERT", ""),
+		"path to client cert presented to HTTPS backends [BACKEND_CLIENT_CERT]",
+	)
+
+	flag.StringVar(
+		&backendClientKey,
+		"backend.client-key",
+		getEnvString("BACKEND_CLIENT_KEY", ""),
+		"path to the private key of the backend client cert [BACKEND_CLIENT_KEY]",
+	)
+
+	flag.StringVar(
+		&backendServerName,
+		"backend.server-name",
+		getEnvString("BACKEND_SERVER_NAME", ""),
+		"server name to verify the backend cert against, defaults to the backend host [BACKEND_SERVER_NAME]",
+	)
+
+	flag.BoolVar(
+		&backendSkipTLSVerify,
+		"backend.skip-tls-validation",
+		getEnvBool("BACKEND_SKIP_TLS_VALIDATION", false),
+		"skip TLS cert validation for the backend [BACKEND_SKIP_TLS_VALIDATION]",
 	)
 
 	flag.BoolVar(
@@ -33,6 +156,20 @@ func init() {
 		"proxy websocket connections [PROXY_WEBSOCKETS]",
 	)
 
+	flag.DurationVar(
+		&websocketIdleTimeout,
+		"websocket.idle-timeout",
+		getEnvDuration("WEBSOCKET_IDLE_TIMEOUT", 0),
+		"close websocket connections without traffic for this long, 0 to disable [WEBSOCKET_IDLE_TIMEOUT]",
+	)
+
+	flag.DurationVar(
+		&websocketMaxLifetime,
+		"websocket.max-lifetime",
+		getEnvDuration("WEBSOCKET_MAX_LIFETIME", 0),
+		"close websocket connections after this long, 0 to disable [WEBSOCKET_MAX_LIFETIME]",
+	)
+
 	flag.StringVar(
 		&redirectToPort,
 		"redirect.port",
@@ -92,7 +229,7 @@ func init() {
 	flag.Var(
 		&uaaRequiredScopes,
 		"uaa.required-scopes",
-		"comma-separated list of required scopes, UAA client for proxy has to be re-created whenever these scopes change [UAA_REQUIRED_SCOPES]",
+		"comma-separated list of scopes required for all paths [UAA_REQUIRED_SCOPES]",
 	)
 
 	flag.StringVar(
@@ -109,6 +246,243 @@ func init() {
 		"skip TLS cert validation [UAA_SKIP_TLS_VALIDATION]",
 	)
 
+	flag.BoolVar(
+		&uaaRequirePKCE,
+		"uaa.require-pkce",
+		getEnvBool("UAA_REQUIRE_PKCE", false),
+		"refuse token exchange without a PKCE code verifier, recommended when running the proxy as public client without secret [UAA_REQUIRE_PKCE]",
+	)
+
+	flag.BoolVar(
+		&uaaVerifyTokens,
+		"uaa.verify-tokens",
+		getEnvBool("UAA_VERIFY_TOKENS", true),
+		"verify signature, issuer, audience, expiry and zone of access tokens using the keys published by UAA [UAA_VERIFY_TOKENS]",
+	)
+
+	flag.StringVar(
+		&uaaIssuer,
+		"uaa.issuer",
+		getEnvString("UAA_ISSUER", ""),
+		"expected issuer of tokens, defaults to the issuer published in UAA's discovery document [UAA_ISSUER]",
+	)
+
+	flag.StringVar(
+		&uaaZoneID,
+		"uaa.zone-id",
+		getEnvString("UAA_ZONE_ID", "uaa"),
+		"expected identity zone of access tokens, empty to skip the check [UAA_ZONE_ID]",
+	)
+
+	flag.BoolVar(
+		&uaaOIDC,
+		"uaa.oidc",
+		getEnvBool("UAA_OIDC", false),
+		"use OpenID Connect, requests openid scope and verifies the id_token returned by UAA [UAA_OIDC]",
+	)
+
+	flag.StringVar(
+		&uaaLogoutPath,
+		"uaa.logout-path",
+		getEnvString("UAA_LOGOUT_PATH", "/auth/logout"),
+		"path of the logout handler, empty to disable logout [UAA_LOGOUT_PATH]",
+	)
+
+	flag.Var(
+		&uaaLogoutRedirectURLs,
+		"uaa.logout-redirect-urls",
+		"comma-separated list of urls UAA may redirect to after logout, the first one is used by default [UAA_LOGOUT_REDIRECT_URLS]",
+	)
+
+	flag.BoolVar(
+		&uaaRevokeOnLogout,
+		"uaa.revoke-on-logout",
+		getEnvBool("UAA_REVOKE_ON_LOGOUT", false),
+		"revoke the user's token at UAA on logout [UAA_REVOKE_ON_LOGOUT]",
+	)
+
+	flag.StringVar(
+		&headerUser,
+		"header.user",
+		getEnvString("HEADER_USER", "X-Forwarded-User"),
+		"request header used to pass the user name to the backend, empty to disable [HEADER_USER]",
+	)
+
+	flag.StringVar(
+		&headerEmail,
+		"header.email",
+		getEnvString("HEADER_EMAIL", "X-Forwarded-Email"),
+		"request header used to pass the user's email to the backend, empty to disable [HEADER_EMAIL]",
+	)
+
+	flag.StringVar(
+		&headerUserID,
+		"header.user-id",
+		getEnvString("HEADER_USER_ID", "X-Forwarded-User-Id"),
+		"request header used to pass the user id to the backend, empty to disable [HEADER_USER_ID]",
+	)
+
+	flag.StringVar(
+		&headerGroups,
+		"header.groups",
+		getEnvString("HEADER_GROUPS", "X-Forwarded-Groups"),
+		"request header used to pass the user's scopes to the backend, empty to disable [HEADER_GROUPS]",
+	)
+
+	flag.StringVar(
+		&headerClientCert,
+		"header.client-cert",
+		getEnvString("HEADER_CLIENT_CERT", "X-Forwarded-Client-Cert"),
+		"request header used to pass the client certificate to the backend, empty to disable [HEADER_CLIENT_CERT]",
+	)
+
+	flag.BoolVar(
+		&headerAccessToken,
+		"header.access-token",
+		getEnvBool("HEADER_ACCESS_TOKEN", false),
+		"pass the user's access token to the backend as bearer token in the Authorization header [HEADER_ACCESS_TOKEN]",
+	)
+
+	flag.StringVar(
+		&policyFile,
+		"policy.file",
+		getEnvString("POLICY_FILE", ""),
+		"path to JSON file with per-path authorization rules, scopes referenced by rules are requested in addition to the required scopes [POLICY_FILE]",
+	)
+
+	flag.Var(
+		&allowUserIDs,
+		"allow.user-ids",
+		"comma-separated list of UAA user ids allowed to access the backend [ALLOW_USER_IDS]",
+	)
+
+	flag.Var(
+		&allowEmails,
+		"allow.emails",
+		"comma-separated list of emails allowed to access the backend [ALLOW_EMAILS]",
+	)
+
+	flag.Var(
+		&allowEmailDomains,
+		"allow.email-domains",
+		"comma-separated list of email domains allowed to access the backend [ALLOW_EMAIL_DOMAINS]",
+	)
+
+	flag.Var(
+		&allowOrigins,
+		"allow.origins",
+		"comma-separated list of UAA origins users must have been authenticated by, e.g. ldap [ALLOW_ORIGINS]",
+	)
+
+	flag.BoolVar(
+		&bearerPassThrough,
+		"bearer.pass-through",
+		getEnvBool("BEARER_PASS_THROUGH", false),
+		"accept requests with a UAA token in the Authorization header without creating a session [BEARER_PASS_THROUGH]",
+	)
+
+	flag.BoolVar(
+		&bearerIntrospect,
+		"bearer.introspect",
+		getEnvBool("BEARER_INTROSPECT", false),
+		"validate bearer tokens using UAA's check_token endpoint instead of verifying their signature, proxy client requires uaa.resource authority [BEARER_INTROSPECT]",
+	)
+
+	flag.StringVar(
+		&bearerAudience,
+		"bearer.audience",
+		getEnvString("BEARER_AUDIENCE", ""),
+		"resource id bearer tokens must list as audience, empty to only check scopes and rules [BEARER_AUDIENCE]",
+	)
+
+	flag.DurationVar(
+		&bearerCacheTTL,
+		"bearer.cache-ttl",
+		getEnvDuration("BEARER_CACHE_TTL", 30*time.Second),
+		"duration for which check_token results are cached [BEARER_CACHE_TTL]",
+	)
+
+	flag.StringVar(
+		&uaaErrorTemplate,
+		"uaa.error-template",
+		getEnvString("UAA_ERROR_TEMPLATE", ""),
+		"path to HTML template used to render errors returned by UAA, e.g. access_denied [UAA_ERROR_TEMPLATE]",
+	)
+
+	flag.Var(
+		&uaaRedirectHosts,
+		"uaa.redirect-hosts",
+		"comma-separated list of hosts users may be redirected to after login, by default only same-origin paths are allowed [UAA_REDIRECT_HOSTS]",
+	)
+
+	flag.StringVar(
+		&uaaDefaultRedirect,
+		"uaa.default-redirect",
+		getEnvString("UAA_DEFAULT_REDIRECT", "/"),
+		"landing page after login if the original request url is not a valid redirect target [UAA_DEFAULT_REDIRECT]",
+	)
+
+	flag.StringVar(
+		&tlsCert,
+		"tls.cert",
+		getEnvString("TLS_CERT", ""),
+		"path to the TLS certificate, enables TLS termination together with tls.key [TLS_CERT]",
+	)
+
+	flag.StringVar(
+		&tlsKey,
+		"tls.key",
+		getEnvString("TLS_KEY", ""),
+		"path to the TLS private key [TLS_KEY]",
+	)
+
+	flag.StringVar(
+		&tlsSNIDir,
+		"tls.sni-dir",
+		getEnvString("TLS_SNI_DIR", ""),
+		"directory of additional <name>.crt and <name>.key pairs selected by SNI [TLS_SNI_DIR]",
+	)
+
+	flag.DurationVar(
+		&tlsReloadInterval,
+		"tls.reload-interval",
+		getEnvDuration("TLS_RELOAD_INTERVAL", 10*time.Second),
+		"interval to check certificate files for changes [TLS_RELOAD_INTERVAL]",
+	)
+
+	flag.StringVar(
+		&tlsMinVersion,
+		"tls.min-version",
+		getEnvString("TLS_MIN_VERSION", "1.2"),
+		"minimum TLS version, one of 1.0, 1.1, 1.2 or 1.3 [TLS_MIN_VERSION]",
+	)
+
+	flag.Var(
+		&tlsCipherSuites,
+		"tls.cipher-suites",
+		"comma-separated list of allowed cipher suites, defaults to Go's secure suites [TLS_CIPHER_SUITES]",
+	)
+
+	flag.StringVar(
+		&tlsClientCA,
+		"tls.client-ca",
+		getEnvString("TLS_CLIENT_CA", ""),
+		"path to a CA bundle, enables authentication with client certificates verified against it [TLS_CLIENT_CA]",
+	)
+
+	flag.Var(
+		&tlsClientCertAllow,
+		"tls.client-cert-allow",
+		"comma-separated list of client certificate subject common names or SANs allowed without login, required scopes, rules and allow lists still apply [TLS_CLIENT_CERT_ALLOW]",
+	)
+
+	flag.StringVar(
+		&tlsRedirectListen,
+		"tls.redirect-listen",
+		getEnvString("TLS_REDIRECT_LISTEN", ""),
+		"optional address of a plain HTTP listener redirecting all requests to HTTPS [TLS_REDIRECT_LISTEN]",
+	)
+
 	flag.StringVar(
 		&sessionAuthKey,
 		"session.auth-key",
@@ -123,6 +497,111 @@ func init() {
 		"key to encrypt session cookies, randomly generated if less than 16 bytes [SESSION_ENCRYPT_KEY]",
 	)
 
+	flag.StringVar(
+		&sessionStore,
+		"session.store",
+		getEnvString("SESSION_STORE", "filesystem"),
+		"where to keep sessions, one of cookie, memory, filesystem or redis [SESSION_STORE]",
+	)
+
+	flag.DurationVar(
+		&sessionMaxAge,
+		"session.max-age",
+		getEnvDuration("SESSION_MAX_AGE", 30*24*time.Hour),
+		"duration after which sessions expire [SESSION_MAX_AGE]",
+	)
+
+	flag.StringVar(
+		&sessionDir,
+		"session.dir",
+		getEnvString("SESSION_DIR", os.TempDir()),
+		"directory used by the filesystem session store [SESSION_DIR]",
+	)
+
+	flag.DurationVar(
+		&sessionCleanupInterval,
+		"session.cleanup-interval",
+		getEnvDuration("SESSION_CLEANUP_INTERVAL", time.Hour),
+		"interval in which expired sessions are removed from the memory and filesystem session stores [SESSION_CLEANUP_INTERVAL]",
+	)
+
+	flag.StringVar(
+		&sessionRedisAddr,
+		"session.redis.addr",
+		getEnvString("SESSION_REDIS_ADDR", "localhost:6379"),
+		"address of the redis server used by the redis session store [SESSION_REDIS_ADDR]",
+	)
+
+	flag.StringVar(
+		&sessionRedisPassword,
+		"session.redis.password",
+		getEnvString("SESSION_REDIS_PASSWORD", ""),
+		"password of the redis server used by the redis session store [SESSION_REDIS_PASSWORD]",
+	)
+
+	flag.IntVar(
+		&sessionRedisDB,
+		"session.redis.db",
+		getEnvInt("SESSION_REDIS_DB", 0),
+		"redis database used by the redis session store [SESSION_REDIS_DB]",
+	)
+
+	flag.StringVar(
+		&stickyCookieName,
+		"sticky.cookie-name",
+		getEnvString("STICKY_COOKIE_NAME", "JSESSIONID"),
+		"name of the sticky session cookie [STICKY_COOKIE_NAME]",
+	)
+
+	flag.StringVar(
+		&stickyCookiePath,
+		"sticky.cookie-path",
+		getEnvString("STICKY_COOKIE_PATH", "/"),
+		"path attribute of the sticky session cookie [STICKY_COOKIE_PATH]",
+	)
+
+	flag.StringVar(
+		&stickyCookieDomain,
+		"sticky.cookie-domain",
+		getEnvString("STICKY_COOKIE_DOMAIN", ""),
+		"domain attribute of the sticky session cookie [STICKY_COOKIE_DOMAIN]",
+	)
+
+	flag.BoolVar(
+		&stickyCookieSecure,
+		"sticky.cookie-secure",
+		getEnvBool("STICKY_COOKIE_SECURE", false),
+		"set the secure attribute of the sticky session cookie [STICKY_COOKIE_SECURE]",
+	)
+
+	flag.BoolVar(
+		&stickyCookieHTTPOnly,
+		"sticky.cookie-http-only",
+		getEnvBool("STICKY_COOKIE_HTTP_ONLY", true),
+		"set the http-only attribute of the sticky session cookie [STICKY_COOKIE_HTTP_ONLY]",
+	)
+
+	flag.StringVar(
+		&stickyCookieSameSite,
+		"sticky.cookie-same-site",
+		getEnvString("STICKY_COOKIE_SAME_SITE", "lax"),
+		"same-site attribute of the sticky session cookie, one of lax, strict, none or empty to omit [STICKY_COOKIE_SAME_SITE]",
+	)
+
+	flag.StringVar(
+		&stickyKey,
+		"sticky.key",
+		getEnvString("STICKY_KEY", ""),
+		"key to sign the backend instance recorded in sticky session cookies, must be shared by all proxy instances, randomly generated if not specified [STICKY_KEY]",
+	)
+
+	flag.BoolVar(
+		&stickyPreserveBackendCookie,
+		"sticky.preserve-backend-cookie",
+		getEnvBool("STICKY_PRESERVE_BACKEND_COOKIE", true),
+		"never overwrite a sticky session cookie issued by the backend, balance based on its value instead, false to replace it with the proxy's cookie [STICKY_PRESERVE_BACKEND_COOKIE]",
+	)
+
 	flag.StringVar(
 		&uaaAdminClientID,
 		"uaa.admin-client.id",
@@ -148,7 +627,7 @@ func init() {
 		&uaaTokenTTL,
 		"uaa.token-ttl",
 		getEnvDuration("UAA_TOKEN_TTL", 2*time.Minute),
-		"duration after which token expires, UAA client for proxy has to be re-created whenever this changes [UAA_TOKEN_TTL]",
+		"duration after which token expires [UAA_TOKEN_TTL]",
 	)
 }
 
@@ -160,7 +639,9 @@ func (s *stringSlice) String() string {
 
 func (s *stringSlice) Set(v string) error {
 	for _, str := range strings.Split(v, ",") {
-		*s = append(*s, str)
+		if str = strings.TrimSpace(str); str != "" {
+			*s = append(*s, str)
+		}
 	}
 	return nil
 }
@@ -188,6 +669,20 @@ func getEnvDuration(key string, def time.Duration) time.Duration {
 	return d
 }
 
+func getEnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+
+	return i
+}
+
 func getEnvBool(key string, def bool) bool {
 	v := os.Getenv(key)
 	if v == "" {
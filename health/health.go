@@ -0,0 +1,210 @@
+// Package health provides liveness and readiness endpoints for platform
+// health checks.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/st3v/uaa-proxy/logging"
+)
+
+// Check probes a dependency, a nil error means the dependency is available.
+type Check func(ctx context.Context) error
+
+// Checker runs readiness checks and caches their results.
+type Checker struct {
+	ttl     time.Duration
+	timeout time.Duration
+
+	names  []string
+	checks map[string]Check
+
+	mu     sync.Mutex
+	report *Report
+}
+
+// Report is the JSON body returned by the readiness endpoint.
+type Report struct {
+	Status    string            `json:"status"`
+	CheckedAt time.Time         `json:"checked_at"`
+	Checks    map[string]Result `json:"checks"`
+}
+
+// Result is the outcome of a single check.
+type Result struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+)
+
+// NewChecker returns a checker caching results for ttl. Every check has to
+// complete within timeout.
+func NewChecker(ttl, timeout time.Duration) *Checker {
+	return &Checker{
+		ttl:     ttl,
+		timeout: timeout,
+		checks:  map[string]Check{},
+	}
+}
+
+// Add registers a named readiness check, replacing any check of that name.
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+	c.report = nil
+}
+
+// Remove unregisters a readiness check.
+func (c *Checker) Remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, n := range c.names {
+		if n == name {
+			c.names = append(c.names[:i:i], c.names[i+1:]...)
+			break
+		}
+	}
+	delete(c.checks, name)
+	c.report = nil
+}
+
+// Liveness responds with ok as long as the process is serving requests.
+func Liveness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": statusOK})
+	})
+}
+
+// Readiness responds with the results of all checks, the status code is 503
+// if any check failed.
+func (c *Checker) Readiness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Report()
+		writeJSON(w, report.code(), report)
+	})
+}
+
+// Status responds with the overall readiness only, leaving out the results
+// of the checks. It is meant for listeners open to the public.
+func (c *Checker) Status() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Report()
+		writeJSON(w, report.code(), map[string]string{"status": report.Status})
+	})
+}
+
+// Report returns the cached results or runs all checks if they have expired.
+// Concurrent callers wait for a single run. Checks do not depend on any
+// caller, the results are shared until they expire.
+func (c *Checker) Report() *Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.report != nil && time.Since(c.report.CheckedAt) < c.ttl {
+		return c.report
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	report := &Report{
+		Status:    statusOK,
+		CheckedAt: time.Now().UTC(),
+		Checks:    map[string]Result{},
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+
+	for _, name := range c.names {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := check(ctx)
+
+			result := Result{
+				Status:     statusOK,
+				DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+
+			if err != nil {
+				logging.Warn("readiness check failed", "check", name, "error", err)
+				result.Status = statusUnavailable
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			report.Checks[name] = result
+			if err != nil {
+				report.Status = statusUnavailable
+			}
+		}(name, c.checks[name])
+	}
+
+	wg.Wait()
+
+	c.report = report
+	return report
+}
+
+func (r *Report) code() int {
+	if r.Status != statusOK {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// HTTPGet returns a check requesting the given URL, any status other than
+// 2xx fails the check.
+func HTTPGet(client *http.Client, url string) Check {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+
+		return nil
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Error("error writing health report", "error", err)
+	}
+}
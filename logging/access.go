@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/st3v/uaa-proxy/util"
+)
+
+// RequestIDHeader carries the id of a request to the backend and back to the
+// client.
+const RequestIDHeader = "X-Request-Id"
+
+type contextKey int
+
+const requestContextKey contextKey = 0
+
+// request holds the details of a request logged once it completes.
+type request struct {
+	id string
+
+	mu     sync.Mutex
+	userID string
+}
+
+// AccessLog returns a handler that assigns an id to every request and, if
+// enabled, writes an access log record once the request completes.
+func AccessLog(handler http.Handler, enabled bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// keep ids assigned by a load balancer in front of the proxy
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		req := &request{id: id}
+		r = r.WithContext(context.WithValue(r.Context(), requestContextKey, req))
+
+		rec := util.NewResponseRecorder(w)
+		handler.ServeHTTP(rec, r)
+
+		if !enabled {
+			return
+		}
+
+		req.mu.Lock()
+		userID := req.userID
+		req.mu.Unlock()
+
+		remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remoteIP = r.RemoteAddr
+		}
+
+		Info("request",
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.Status(),
+			"bytes", rec.Bytes(),
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote_ip", remoteIP,
+			"forwarded_for", r.Header.Get("X-Forwarded-For"),
+			"user_id", userID,
+		)
+	})
+}
+
+// FromRequest returns a logger adding the id of the request to every
+// record.
+func FromRequest(r *http.Request) *Logger {
+	if req, ok := r.Context().Value(requestContextKey).(*request); ok {
+		return root.With("request_id", req.id)
+	}
+	return root
+}
+
+// SetUserID records the id of the authenticated user for the access log.
+func SetUserID(ctx context.Context, id string) {
+	if req, ok := ctx.Value(requestContextKey).(*request); ok {
+		req.mu.Lock()
+		req.userID = id
+		req.mu.Unlock()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,213 @@
+// Package logging writes structured log records in JSON or logfmt format.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log record.
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses one of debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q", s)
+}
+
+// supported formats
+const (
+	JSON   = "json"
+	Logfmt = "logfmt"
+)
+
+var out = struct {
+	sync.Mutex
+	w      io.Writer
+	format string
+	level  Level
+}{
+	w:      os.Stderr,
+	format: Logfmt,
+	level:  InfoLevel,
+}
+
+// Configure sets output, format and minimum level of all log records.
+func Configure(w io.Writer, format string, level Level) error {
+	if format != JSON && format != Logfmt {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	out.Lock()
+	defer out.Unlock()
+
+	out.w = w
+	out.format = format
+	out.level = level
+
+	return nil
+}
+
+// Logger adds a set of fields to every record it writes.
+type Logger struct {
+	fields []interface{}
+}
+
+var root = &Logger{}
+
+// With returns a logger adding the given key-value pairs to every record.
+func With(keyvals ...interface{}) *Logger {
+	return root.With(keyvals...)
+}
+
+// With returns a logger adding the given key-value pairs to every record in
+// addition to the fields of l.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{fields}
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(DebugLevel, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.log(InfoLevel, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.log(WarnLevel, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(ErrorLevel, msg, keyvals) }
+
+func Debug(msg string, keyvals ...interface{}) { root.log(DebugLevel, msg, keyvals) }
+func Info(msg string, keyvals ...interface{})  { root.log(InfoLevel, msg, keyvals) }
+func Warn(msg string, keyvals ...interface{})  { root.log(WarnLevel, msg, keyvals) }
+func Error(msg string, keyvals ...interface{}) { root.log(ErrorLevel, msg, keyvals) }
+
+// Fatal writes an error record and exits.
+func Fatal(msg string, keyvals ...interface{}) {
+	root.log(ErrorLevel, msg, keyvals)
+	os.Exit(1)
+}
+
+// Enabled reports whether records of the given level are written.
+func Enabled(level Level) bool {
+	out.Lock()
+	defer out.Unlock()
+	return level >= out.level
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !Enabled(level) {
+		return
+	}
+
+	fields := []interface{}{
+		"time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		"level", level.String(),
+		"msg", msg,
+	}
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+
+	// a key without value is most likely a mistake, keep it anyway
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(MISSING)")
+	}
+
+	out.Lock()
+	defer out.Unlock()
+
+	var buf bytes.Buffer
+	if out.format == JSON {
+		writeJSON(&buf, fields)
+	} else {
+		writeLogfmt(&buf, fields)
+	}
+
+	out.w.Write(buf.Bytes())
+}
+
+func writeJSON(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value, err := json.Marshal(jsonValue(fields[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+
+		value := fmt.Sprint(fields[i+1])
+		if needsQuoting(value) {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}
@@ -1,117 +1,276 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
+	"html/template"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/st3v/uaa-proxy/config"
+	"github.com/st3v/uaa-proxy/health"
+	"github.com/st3v/uaa-proxy/logging"
+	"github.com/st3v/uaa-proxy/metrics"
 	"github.com/st3v/uaa-proxy/proxy"
 	"github.com/st3v/uaa-proxy/redirect"
+	"github.com/st3v/uaa-proxy/router"
 	"github.com/st3v/uaa-proxy/sticky"
+	"github.com/st3v/uaa-proxy/tlsconfig"
 	"github.com/st3v/uaa-proxy/uaa"
 	"github.com/st3v/uaa-proxy/uaa/register"
+	"github.com/st3v/uaa-proxy/uaa/store"
+
+	"github.com/gorilla/sessions"
 )
 
 // flags
 var (
-	listenAddr                string
-	backendAddr               string
-	redirectToPort            string
-	redirectToProto           string
-	proxyWebsockets           bool
-	uaaURL                    string
-	uaaInternalURL            string
-	uaaAdminClientID          string
-	uaaAdminClientSecret      string
-	uaaRegisterProxyClient    bool
-	uaaProxyClientName        string
-	uaaProxyClientID          string
-	uaaProxyClientSecret      string
-	uaaProxyClientRedirectURL string
-	uaaRequiredScopes         stringSlice
-	uaaCACertPath             string
-	uaaSkipTLSVerify          bool
-	uaaTokenTTL               time.Duration
-	sessionAuthKey            string
-	sessionEncryptKey         string
+	listenAddr                  string
+	shutdownTimeout             time.Duration
+	adminListen                 string
+	logFormat                   string
+	logLevel                    string
+	logAccess                   bool
+	healthLivenessPath          string
+	healthReadinessPath         string
+	healthUAAPath               string
+	healthCacheTTL              time.Duration
+	healthTimeout               time.Duration
+	backendAddr                 string
+	backendCACertPath           string
+	backendClientCert           string
+	backendClientKey            string
+	backendServerName           string
+	backendSkipTLSVerify        bool
+	redirectToPort              string
+	redirectToProto             string
+	proxyWebsockets             bool
+	websocketIdleTimeout        time.Duration
+	websocketMaxLifetime        time.Duration
+	uaaURL                      string
+	uaaInternalURL              string
+	uaaAdminClientID            string
+	uaaAdminClientSecret        string
+	uaaRegisterProxyClient      bool
+	uaaProxyClientName          string
+	uaaProxyClientID            string
+	uaaProxyClientSecret        string
+	uaaProxyClientRedirectURL   string
+	uaaRequiredScopes           stringSlice
+	uaaCACertPath               string
+	uaaSkipTLSVerify            bool
+	uaaTokenTTL                 time.Duration
+	uaaRequirePKCE              bool
+	uaaVerifyTokens             bool
+	uaaIssuer                   string
+	uaaZoneID                   string
+	uaaOIDC                     bool
+	uaaLogoutPath               string
+	uaaLogoutRedirectURLs       stringSlice
+	uaaRevokeOnLogout           bool
+	headerUser                  string
+	headerEmail                 string
+	headerUserID                string
+	headerGroups                string
+	headerClientCert            string
+	headerAccessToken           bool
+	policyFile                  string
+	routesFile                  string
+	allowUserIDs                stringSlice
+	allowEmails                 stringSlice
+	allowEmailDomains           stringSlice
+	allowOrigins                stringSlice
+	bearerPassThrough           bool
+	bearerIntrospect            bool
+	bearerAudience              string
+	bearerCacheTTL              time.Duration
+	uaaErrorTemplate            string
+	uaaRedirectHosts            stringSlice
+	uaaDefaultRedirect          string
+	tlsCert                     string
+	tlsKey                      string
+	tlsSNIDir                   string
+	tlsReloadInterval           time.Duration
+	tlsMinVersion               string
+	tlsCipherSuites             stringSlice
+	tlsClientCA                 string
+	tlsClientCertAllow          stringSlice
+	tlsRedirectListen           string
+	sessionAuthKey              string
+	sessionEncryptKey           string
+	sessionStore                string
+	sessionMaxAge               time.Duration
+	sessionDir                  string
+	sessionCleanupInterval      time.Duration
+	sessionRedisAddr            string
+	sessionRedisPassword        string
+	sessionRedisDB              int
+	stickyCookieName            string
+	stickyCookiePath            string
+	stickyCookieDomain          string
+	stickyCookieSecure          bool
+	stickyCookieHTTPOnly        bool
+	stickyCookieSameSite        string
+	stickyKey                   string
+	stickyPreserveBackendCookie bool
+	configFile                  string
+	configWatchInterval         time.Duration
 )
 
 const defaultSessionName = "uaaproxy"
 
 func main() {
 	flag.Parse()
+
+	// settings of the config file take precedence over the environment
+	var file *config.File
+	if configFile != "" {
+		var err error
+		if file, err = config.Load(configFile); err != nil {
+			logging.Fatal("invalid configuration", "error", err)
+		}
+
+		if err := file.Apply(flag.CommandLine); err != nil {
+			logging.Fatal("invalid configuration", "error", err)
+		}
+	}
+
 	if len(uaaRequiredScopes) == 0 {
 		flag.Set("uaa.required-scopes", getEnvString("UAA_REQUIRED_SCOPES", ""))
 	}
+	if len(uaaLogoutRedirectURLs) == 0 {
+		flag.Set("uaa.logout-redirect-urls", getEnvString("UAA_LOGOUT_REDIRECT_URLS", ""))
+	}
+	if len(uaaRedirectHosts) == 0 {
+		flag.Set("uaa.redirect-hosts", getEnvString("UAA_REDIRECT_HOSTS", ""))
+	}
+	if len(tlsCipherSuites) == 0 {
+		flag.Set("tls.cipher-suites", getEnvString("TLS_CIPHER_SUITES", ""))
+	}
+	if len(tlsClientCertAllow) == 0 {
+		flag.Set("tls.client-cert-allow", getEnvString("TLS_CLIENT_CERT_ALLOW", ""))
+	}
+	if len(allowUserIDs) == 0 {
+		flag.Set("allow.user-ids", getEnvString("ALLOW_USER_IDS", ""))
+	}
+	if len(allowEmails) == 0 {
+		flag.Set("allow.emails", getEnvString("ALLOW_EMAILS", ""))
+	}
+	if len(allowEmailDomains) == 0 {
+		flag.Set("allow.email-domains", getEnvString("ALLOW_EMAIL_DOMAINS", ""))
+	}
+	if len(allowOrigins) == 0 {
+		flag.Set("allow.origins", getEnvString("ALLOW_ORIGINS", ""))
+	}
+
+	if uaaInternalURL == "" {
+		uaaInternalURL = uaaURL
+	}
 
-	if backendAddr == "" {
+	// dry run
+	switch flag.Arg(0) {
+	case "":
+	case "validate":
+		if err := validate(file); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration is valid")
+		return
+	default:
 		flag.Usage()
-		log.Fatalln("Must specify target address")
+		logging.Fatal("unknown command", "command", flag.Arg(0))
 	}
 
-	backend, err := url.Parse(backendAddr)
-	if err != nil {
-		log.Fatalf("Error parsing URL %q: %v\n", backendAddr, err)
+	if err := checkFlags(); err != nil {
+		logging.Fatal("invalid configuration", "error", err)
 	}
 
-	redirectURL, err := url.Parse(uaaProxyClientRedirectURL)
+	// validated by checkFlags
+	level, _ := logging.ParseLevel(logLevel)
+	logging.Configure(os.Stderr, logFormat, level)
+	redirectURL, _ := url.Parse(uaaProxyClientRedirectURL)
+	oauthServerURL, _ := url.Parse(uaaInternalURL)
+
+	// routing table and policy, a single backend unless routes are given
+	routes, policy, err := loadRoutes(file)
+	if err == errNoBackend {
+		flag.Usage()
+	}
 	if err != nil {
-		log.Fatalf("Error parsing UAA redirect URL %q: %v\n", uaaProxyClientRedirectURL, err)
+		logging.Fatal("invalid routes", "error", err)
 	}
 
-	if uaaInternalURL == "" {
-		uaaInternalURL = uaaURL
+	// request required scopes as well as all scopes referenced by the policy
+	// and the routes
+	scopes := append([]string{}, uaaRequiredScopes...)
+	for _, scope := range routeScopes(routes, policy) {
+		if !contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
 	}
 
-	oauthServerURL, err := url.Parse(uaaInternalURL)
-	if err != nil {
-		log.Fatalf("Error parsing UAA internal URL %q: %v\n", uaaInternalURL, err)
+	if uaaOIDC {
+		scopes = append(scopes, "openid")
 	}
 
 	// register UAA client for proxy
 	if uaaRegisterProxyClient {
-		log.Println("Registering UAA client for proxy...")
+		logging.Info("registering UAA client for proxy", "client_id", uaaProxyClientID)
 
 		registrar, err := register.Registrar(
 			uaaInternalURL, uaaAdminClientID, uaaAdminClientSecret, uaaCACertPath, uaaSkipTLSVerify,
 		)
 		if err != nil {
-			log.Fatalf("Error creating UAA client registrar: %v\n", err)
+			logging.Fatal("error creating UAA client registrar", "error", err)
 		}
 
-		err = registrar.RegisterClient(
+		result, err := registrar.RegisterClient(
 			uaaProxyClientID,
 			uaaProxyClientSecret,
 			register.WithName(uaaProxyClientName),
 			register.WithGrantTypes("authorization_code", "refresh_token"),
-			register.WithScopes(uaaRequiredScopes...),
+			register.WithScopes(scopes...),
 			register.WithAuthorities("uaa.resource"),
 			register.WithTokenTTL(uaaTokenTTL),
-			register.WithRedirectURLs(redirectURL.String()),
+			register.WithRedirectURLs(append([]string{redirectURL.String()}, uaaLogoutRedirectURLs...)...),
 		)
 
-		if err != nil {
-			log.Printf("Error registering UAA client for proxy: %v\n", err)
-		} else {
-			log.Println("Done registering UAA client for proxy")
+		switch {
+		case err != nil:
+			logging.Error("error registering UAA client for proxy", "error", err)
+		case result.Created:
+			logging.Info("created UAA client for proxy", "client_id", uaaProxyClientID)
+		case !result.Changed():
+			logging.Info("UAA client for proxy is up to date", "client_id", uaaProxyClientID)
+		default:
+			for _, change := range result.Changes {
+				logging.Info("updated UAA client for proxy", "client_id", uaaProxyClientID, "change", change)
+			}
+			if result.SecretChanged {
+				logging.Info("changed secret of UAA client for proxy", "client_id", uaaProxyClientID)
+			}
 		}
 	}
 
-	oauth := uaa.Config(uaaURL, uaaProxyClientID, uaaProxyClientSecret, uaaRequiredScopes, redirectURL.String())
-
-	session := uaa.NewSessionStore(defaultSessionName, []byte(sessionAuthKey), []byte(sessionEncryptKey))
-
 	caCertPool := x509.NewCertPool()
 
 	if uaaCACertPath != "" {
 		cert, err := ioutil.ReadFile(uaaCACertPath)
 		if err != nil {
-			log.Fatalf("Error reading UAA CA cert: %v\n", err)
+			logging.Fatal("error reading UAA CA cert", "file", uaaCACertPath, "error", err)
 		}
 		caCertPool.AppendCertsFromPEM(cert)
 	}
@@ -129,19 +288,153 @@ func main() {
 		},
 	}
 
-	// basic HTTP proxy
-	server := proxy.HTTP(backend)
+	// discover UAA endpoints
+	provider, err := uaa.Discover(uaaURL, httpClient)
+	if err != nil {
+		logging.Warn("error discovering UAA endpoints, using defaults", "error", err)
+		provider = uaa.DefaultProvider(uaaURL)
+	}
+
+	oauth := uaa.Config(provider, uaaProxyClientID, uaaProxyClientSecret, scopes, redirectURL.String())
 
-	// websocket proxy
-	if proxyWebsockets {
-		server = proxy.Websocket(backend.Host, server)
+	store, err := newSessionStore()
+	if err != nil {
+		logging.Fatal("error creating session store", "store", sessionStore, "error", err)
 	}
 
-	// oauth2 authorization handler
-	server = uaa.Authorize(oauth, session, httpClient, server)
+	session := uaa.NewSessionStore(defaultSessionName, store)
 
-	// sticky sessions handler
-	server = sticky.Session(server)
+	uaaOpts := []uaa.Option{
+		uaa.WithPKCERequired(uaaRequirePKCE),
+		uaa.WithTokenRevocation(uaaRevokeOnLogout),
+		uaa.WithLogoutRedirects(uaaLogoutRedirectURLs...),
+		uaa.WithRequiredScopes(uaaRequiredScopes...),
+		uaa.WithRedirectHosts(uaaRedirectHosts...),
+		uaa.WithDefaultRedirect(uaaDefaultRedirect),
+	}
+
+	if uaaIssuer == "" {
+		uaaIssuer = provider.Issuer
+	}
+
+	verifier := uaa.NewTokenVerifier(provider.KeysURL, uaaIssuer, uaaProxyClientID, uaaZoneID, httpClient)
+
+	// custom page for OAuth errors returned by UAA
+	if uaaErrorTemplate != "" {
+		tmpl, err := template.ParseFiles(uaaErrorTemplate)
+		if err != nil {
+			logging.Fatal("error parsing error template", "file", uaaErrorTemplate, "error", err)
+		}
+		uaaOpts = append(uaaOpts, uaa.WithErrorTemplate(tmpl))
+	}
+
+	// verify tokens against the keys published by UAA
+	if uaaVerifyTokens {
+		uaaOpts = append(uaaOpts, uaa.WithTokenVerifier(verifier))
+	}
+
+	// verify id_tokens and expose user claims
+	if uaaOIDC {
+		uaaOpts = append(uaaOpts, uaa.WithOpenIDConnect(verifier))
+	}
+
+	// accept bearer tokens from API clients
+	if bearerPassThrough {
+		var validator uaa.TokenValidator = uaa.NewTokenVerifier(
+			provider.KeysURL, uaaIssuer, bearerAudience, uaaZoneID, httpClient,
+		)
+
+		if bearerIntrospect {
+			validator = uaa.NewTokenIntrospector(
+				fmt.Sprintf("%s/check_token", uaaURL),
+				uaaProxyClientID, uaaProxyClientSecret, bearerAudience, bearerCacheTTL, httpClient,
+			)
+		}
+
+		uaaOpts = append(uaaOpts, uaa.WithBearerTokens(validator))
+	}
+
+	// restrict access to specific users
+	if len(allowUserIDs)+len(allowEmails)+len(allowEmailDomains)+len(allowOrigins) > 0 {
+		uaaOpts = append(uaaOpts, uaa.WithAllowList(&uaa.AllowList{
+			UserIDs:      allowUserIDs,
+			Emails:       allowEmails,
+			EmailDomains: allowEmailDomains,
+			Origins:      allowOrigins,
+		}))
+	}
+
+	// authenticate machine clients by their certificate
+	if len(tlsClientCertAllow) > 0 {
+		uaaOpts = append(uaaOpts, uaa.WithClientCertificates(tlsClientCertAllow...))
+	}
+
+	backendTLS, err := tlsconfig.Client(backendCACertPath, backendClientCert, backendClientKey, backendServerName, backendSkipTLSVerify)
+	if err != nil {
+		logging.Fatal("invalid backend TLS configuration", "error", err)
+	}
+
+	// websocket connections are hijacked and need to be drained separately
+	websockets := proxy.NewConnections()
+
+	proxyOpts := []proxy.Option{
+		proxy.WithTLSConfig(backendTLS),
+		proxy.WithIdentityHeaders(proxy.IdentityHeaders{
+			User:        headerUser,
+			Email:       headerEmail,
+			UserID:      headerUserID,
+			Groups:      headerGroups,
+			ClientCert:  headerClientCert,
+			AccessToken: headerAccessToken,
+		}),
+	}
+
+	wsOpts := []proxy.Option{
+		proxy.WithIdleTimeout(websocketIdleTimeout),
+		proxy.WithMaxLifetime(websocketMaxLifetime),
+		proxy.WithConnections(websockets),
+	}
+
+	// health checks of backend instances use the backend TLS settings
+	backendTransport := http.DefaultTransport.(*http.Transport).Clone()
+	backendTransport.TLSClientConfig = backendTLS
+	backendClient := &http.Client{Transport: backendTransport}
+
+	// readiness depends on UAA and the backends
+	checker := health.NewChecker(healthCacheTTL, healthTimeout)
+	checker.Add("uaa", health.HTTPGet(httpClient, strings.TrimSuffix(uaaURL, "/")+healthUAAPath))
+
+	// the handlers of the routes are rebuilt on reload
+	handlers := &chain{
+		oauth:         oauth,
+		session:       session,
+		httpClient:    httpClient,
+		uaaOpts:       uaaOpts,
+		proxyOpts:     proxyOpts,
+		wsOpts:        wsOpts,
+		backendClient: backendClient,
+		checker:       checker,
+		scopes:        scopes,
+		file:          file,
+	}
+
+	gen, err := handlers.build(routes, policy)
+	if err != nil {
+		logging.Fatal("error creating backend pools", "error", err)
+	}
+	handlers.activate(gen)
+
+	var server http.Handler = handlers
+
+	// sticky sessions handler, same-site has been validated by checkFlags
+	sameSite, _ := parseSameSite(stickyCookieSameSite)
+	server = sticky.Session(
+		server,
+		sticky.WithCookieName(stickyCookieName),
+		sticky.WithCookieAttributes(stickyCookiePath, stickyCookieDomain, stickyCookieSecure, stickyCookieHTTPOnly, sameSite),
+		sticky.WithSigningKey([]byte(stickyKey)),
+		sticky.WithPreservedBackendCookie(stickyPreserveBackendCookie),
+	)
 
 	// port redirection handler
 	if redirectToPort != "" {
@@ -155,10 +448,314 @@ func main() {
 
 	mux := http.NewServeMux()
 	mux.Handle("/", server)
-	mux.Handle(redirectURL.Path, uaa.Callback(oauth, session, httpClient))
 
-	log.Printf("Listening on %s...", listenAddr)
-	log.Fatal(http.ListenAndServe(listenAddr, mux))
+	// health checks must not require a login
+	if healthLivenessPath != "" {
+		mux.Handle(healthLivenessPath, health.Liveness())
+	}
+	if healthReadinessPath != "" {
+		mux.Handle(healthReadinessPath, checker.Status())
+	}
+	mux.Handle(redirectURL.Path, uaa.Callback(oauth, session, httpClient, uaaOpts...))
+
+	if uaaLogoutPath != "" {
+		mux.Handle(uaaLogoutPath, uaa.Logout(uaaURL, oauth, session, httpClient, uaaOpts...))
+	}
+
+	servers := []*http.Server{{
+		Addr:    listenAddr,
+		Handler: logging.AccessLog(metrics.Instrument(mux), logAccess),
+	}}
+
+	if tlsCert != "" {
+		servers[0].TLSConfig, err = newTLSConfig()
+		if err != nil {
+			logging.Fatal("invalid TLS configuration", "error", err)
+		}
+
+		if tlsRedirectListen != "" {
+			_, port, err := net.SplitHostPort(listenAddr)
+			if err != nil {
+				logging.Fatal("invalid listen address", "address", listenAddr, "error", err)
+			}
+
+			servers = append(servers, &http.Server{
+				Addr:    tlsRedirectListen,
+				Handler: redirect.HTTPS(port),
+			})
+		}
+	}
+
+	// admin endpoints are kept off the proxied listener
+	if adminListen != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/metrics", metrics.Handler())
+		admin.Handle("/healthz", health.Liveness())
+		admin.Handle("/readyz", checker.Readiness())
+
+		servers = append(servers, &http.Server{
+			Addr:    adminListen,
+			Handler: admin,
+		})
+	}
+
+	for _, srv := range servers {
+		go serve(srv)
+	}
+
+	// reload routes and policy whenever their files change
+	var changes <-chan struct{}
+	if sources := configSources(); configWatchInterval > 0 && len(sources) > 0 {
+		changes = config.Watch(configWatchInterval, sources...)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+
+	// wait for the platform to stop us
+	for {
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				logging.Info("shutting down", "signal", sig)
+				shutdown(servers, websockets, shutdownTimeout)
+				return
+			}
+
+			logging.Info("reloading configuration", "signal", sig)
+		case <-changes:
+			logging.Info("reloading configuration", "reason", "files changed")
+		}
+
+		if err := handlers.reload(); err != nil {
+			logging.Error("error reloading configuration, keeping current configuration", "error", err)
+		}
+	}
+}
+
+func serve(srv *http.Server) {
+	var err error
+	if srv.TLSConfig != nil {
+		logging.Info("listening", "address", srv.Addr, "tls", true)
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		logging.Info("listening", "address", srv.Addr, "tls", false)
+		err = srv.ListenAndServe()
+	}
+
+	if err != http.ErrServerClosed {
+		logging.Fatal("error serving", "address", srv.Addr, "error", err)
+	}
+}
+
+// shutdown stops accepting connections and waits for in-flight requests and
+// websocket connections to finish. Whatever is left at the deadline gets
+// closed.
+func shutdown(servers []*http.Server, websockets *proxy.Connections, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := websockets.Shutdown(ctx); err != nil {
+			logging.Warn("closed remaining websocket connections", "error", err)
+		}
+	}()
+
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				logging.Warn("error draining connections", "address", srv.Addr, "error", err)
+				srv.Close()
+			}
+		}(srv)
+	}
+
+	wg.Wait()
+	logging.Info("shutdown complete")
+}
+
+// checkFlags validates the flags without contacting UAA or the backends
+func checkFlags() error {
+	if _, err := logging.ParseLevel(logLevel); err != nil {
+		return err
+	}
+
+	if logFormat != logging.JSON && logFormat != logging.Logfmt {
+		return fmt.Errorf("unknown log format %q", logFormat)
+	}
+
+	if (tlsCert == "") != (tlsKey == "") {
+		return errors.New("must specify both tls.cert and tls.key")
+	}
+
+	if tlsClientCA != "" && tlsCert == "" {
+		return errors.New("client certificates require TLS, must specify tls.cert and tls.key")
+	}
+
+	if len(tlsClientCertAllow) > 0 && tlsClientCA == "" {
+		return errors.New("client certificate allow list requires tls.client-ca")
+	}
+
+	if len(allowUserIDs)+len(allowEmails)+len(allowEmailDomains)+len(allowOrigins) > 0 && !uaaVerifyTokens && !uaaOIDC {
+		return errors.New("allow lists require either uaa.verify-tokens or uaa.oidc")
+	}
+
+	if _, err := url.Parse(uaaProxyClientRedirectURL); err != nil {
+		return fmt.Errorf("error parsing UAA redirect URL: %v", err)
+	}
+
+	if _, err := url.Parse(uaaInternalURL); err != nil {
+		return fmt.Errorf("error parsing UAA internal URL: %v", err)
+	}
+
+	if _, err := parseSameSite(stickyCookieSameSite); err != nil {
+		return fmt.Errorf("invalid sticky cookie same-site attribute: %v", err)
+	}
+
+	switch sessionStore {
+	case "cookie", "memory", "filesystem", "redis":
+	default:
+		return fmt.Errorf("unknown session store %q", sessionStore)
+	}
+
+	return nil
+}
+
+// validate checks the complete configuration including routes, policy,
+// certificates and templates without serving any requests
+func validate(file *config.File) error {
+	if err := checkFlags(); err != nil {
+		return err
+	}
+
+	if _, _, err := loadRoutes(file); err != nil {
+		return err
+	}
+
+	if tlsCert != "" {
+		tlsReloadInterval = 0
+		if _, err := newTLSConfig(); err != nil {
+			return fmt.Errorf("invalid TLS configuration: %v", err)
+		}
+	}
+
+	if _, err := tlsconfig.Client(backendCACertPath, backendClientCert, backendClientKey, backendServerName, backendSkipTLSVerify); err != nil {
+		return fmt.Errorf("invalid backend TLS configuration: %v", err)
+	}
+
+	if uaaErrorTemplate != "" {
+		if _, err := template.ParseFiles(uaaErrorTemplate); err != nil {
+			return fmt.Errorf("error parsing error template: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// configSources returns the files routes and policy are loaded from
+func configSources() []string {
+	sources := []string{}
+	for _, file := range []string{configFile, routesFile, policyFile} {
+		if file != "" {
+			sources = append(sources, file)
+		}
+	}
+	return sources
+}
+
+// routePolicy appends the authorization rule of a route to the policy, paths
+// covered by the policy keep their rules
+func routePolicy(policy *uaa.Policy, route router.Route) *uaa.Policy {
+	if !route.Anonymous && len(route.Scopes) == 0 {
+		return policy
+	}
+
+	rules := append([]uaa.Rule{}, policy.Rules...)
+	return &uaa.Policy{Rules: append(rules, route.Rule())}
+}
+
+// backendCheckName returns the name of the readiness check of a route's
+// backend
+func backendCheckName(route router.Route, routes int) string {
+	switch {
+	case routes == 1:
+		return "backend"
+	default:
+		return "backend:" + route.ID()
+	}
+}
+
+// newTLSConfig returns the TLS configuration selected by the tls flags
+func newTLSConfig() (*tls.Config, error) {
+	certs, err := tlsconfig.NewCertStore(tlsCert, tlsKey, tlsSNIDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsReloadInterval > 0 {
+		go certs.Watch(tlsReloadInterval)
+	}
+
+	config, err := tlsconfig.Server(certs, tlsMinVersion, tlsCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsClientCA != "" {
+		if err := tlsconfig.RequestClientCerts(config, tlsClientCA); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, h := range haystack {
+		if h == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSameSite parses the same-site attribute of the sticky session cookie
+func parseSameSite(mode string) (http.SameSite, error) {
+	switch strings.ToLower(mode) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("unknown mode %q", mode)
+}
+
+// newSessionStore returns the session store selected by the session.store flag
+func newSessionStore() (sessions.Store, error) {
+	hashKey, blockKey := store.Keys([]byte(sessionAuthKey), []byte(sessionEncryptKey))
+
+	switch sessionStore {
+	case "cookie":
+		return store.NewCookie(sessionMaxAge, hashKey, blockKey), nil
+	case "memory":
+		return store.NewMemory(sessionMaxAge, sessionCleanupInterval, hashKey, blockKey), nil
+	case "filesystem":
+		return store.NewFilesystem(sessionDir, sessionMaxAge, sessionCleanupInterval, hashKey, blockKey), nil
+	case "redis":
+		return store.NewRedis(sessionRedisAddr, sessionRedisPassword, sessionRedisDB, sessionMaxAge, hashKey, blockKey), nil
+	}
+
+	return nil, fmt.Errorf("unknown session store %q", sessionStore)
 }
 
 // urlswitcher is used to handle internal and external URLs for oauth2 server
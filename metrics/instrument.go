@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/st3v/uaa-proxy/util"
+)
+
+// Instrument returns a handler that counts requests and measures their
+// latency by status code.
+func Instrument(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		rec := util.NewResponseRecorder(w)
+		handler.ServeHTTP(rec, r)
+
+		code := strconv.Itoa(rec.Status())
+		Requests.Inc(code, method(r.Method))
+		RequestDuration.Observe(time.Since(start).Seconds(), code)
+	})
+}
+
+// method returns the request method as label value. Unknown methods are
+// reported as OTHER to bound the number of series.
+func method(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodConnect,
+		http.MethodOptions, http.MethodTrace:
+		return m
+	default:
+		return "OTHER"
+	}
+}
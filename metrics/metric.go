@@ -0,0 +1,265 @@
+// Package metrics collects metrics of the proxy and exposes them in the
+// Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	registryMu sync.Mutex
+	registry   []*metric
+)
+
+// metric is a set of time series sharing name and label names.
+type metric struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+
+	value float64
+
+	// histograms only
+	counts []uint64
+	count  uint64
+}
+
+func newMetric(name, help, typ string, buckets []float64, labels ...string) *metric {
+	m := &metric{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+
+	// metrics without labels are exposed from the start
+	if len(labels) == 0 {
+		m.with(nil, func(*series) {})
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+
+	return m
+}
+
+// with calls fn with the series identified by the given label values while
+// holding the lock of the metric.
+func (m *metric) with(labelValues []string, fn func(s *series)) {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(m.buckets)),
+		}
+		m.series[key] = s
+	}
+
+	fn(s)
+}
+
+func (m *metric) delete(labelValues []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.series, strings.Join(labelValues, "\xff"))
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	m *metric
+}
+
+// NewCounter registers a new counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newMetric(name, help, "counter", nil, labels...)}
+}
+
+// Inc increments the counter for the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds a non-negative value to the counter for the given label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.m.with(labelValues, func(s *series) {
+		s.value += v
+	})
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	m *metric
+}
+
+// NewGauge registers a new gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{newMetric(name, help, "gauge", nil, labels...)}
+}
+
+// Inc increments the gauge for the given label values.
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec decrements the gauge for the given label values.
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Add adds a value to the gauge for the given label values.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.m.with(labelValues, func(s *series) {
+		s.value += v
+	})
+}
+
+// Set sets the gauge for the given label values.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.with(labelValues, func(s *series) {
+		s.value = v
+	})
+}
+
+// Delete removes the series of the given label values.
+func (g *Gauge) Delete(labelValues ...string) {
+	g.m.delete(labelValues)
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	m *metric
+}
+
+// NewHistogram registers a new histogram with the given upper bounds of its
+// buckets, which must be sorted, and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{newMetric(name, help, "histogram", buckets, labels...)}
+}
+
+// Observe adds an observation for the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.with(labelValues, func(s *series) {
+		for i, bound := range h.m.buckets {
+			if v <= bound {
+				s.counts[i]++
+			}
+		}
+		s.count++
+		s.value += v
+	})
+}
+
+// WriteTo writes all registered metrics in the Prometheus text format.
+func WriteTo(w io.Writer) error {
+	registryMu.Lock()
+	metrics := append([]*metric{}, registry...)
+	registryMu.Unlock()
+
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *metric) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.series) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n", m.name, escape(m.help, false))
+	fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.typ)
+
+	for _, k := range keys {
+		s := m.series[k]
+
+		if m.typ != "histogram" {
+			fmt.Fprintf(&b, "%s%s %s\n", m.name, m.labelPairs(s, ""), formatFloat(s.value))
+			continue
+		}
+
+		for i, bound := range m.buckets {
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", m.name, m.labelPairs(s, formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket%s %d\n", m.name, m.labelPairs(s, "+Inf"), s.count)
+		fmt.Fprintf(&b, "%s_sum%s %s\n", m.name, m.labelPairs(s, ""), formatFloat(s.value))
+		fmt.Fprintf(&b, "%s_count%s %d\n", m.name, m.labelPairs(s, ""), s.count)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labelPairs formats the labels of a series, le is added for histogram
+// buckets if not empty.
+func (m *metric) labelPairs(s *series, le string) string {
+	pairs := []string{}
+	for i, name := range m.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escape(s.labelValues[i], true)))
+	}
+
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=\"%s\"", le))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/st3v/uaa-proxy/logging"
+)
+
+// metrics of the proxy
+var (
+	Requests = NewCounter(
+		"uaaproxy_http_requests_total",
+		"Total number of HTTP requests by status code and method.",
+		"code", "method",
+	)
+
+	RequestDuration = NewHistogram(
+		"uaaproxy_http_request_duration_seconds",
+		"Latency of HTTP requests by status code.",
+		DefBuckets,
+		"code",
+	)
+
+	BackendErrors = NewCounter(
+		"uaaproxy_backend_errors_total",
+		"Total number of failed requests to the backend.",
+	)
+
+	BackendUp = NewGauge(
+		"uaaproxy_backend_up",
+		"Whether a backend instance passed its active health check.",
+		"route", "backend",
+	)
+
+	WebsocketsOpen = NewGauge(
+		"uaaproxy_websocket_connections",
+		"Number of open websocket connections.",
+	)
+
+	Websockets = NewCounter(
+		"uaaproxy_websocket_connections_total",
+		"Total number of websocket connections.",
+	)
+
+	LoginRedirects = NewCounter(
+		"uaaproxy_login_redirects_total",
+		"Total number of redirects to the UAA login.",
+	)
+
+	Callbacks = NewCounter(
+		"uaaproxy_callbacks_total",
+		"Total number of OAuth callbacks by outcome.",
+		"outcome",
+	)
+
+	TokenRefreshes = NewCounter(
+		"uaaproxy_token_refreshes_total",
+		"Total number of access token refreshes by result.",
+		"result",
+	)
+
+	TokenRequestDuration = NewHistogram(
+		"uaaproxy_uaa_token_request_duration_seconds",
+		"Latency of requests to the UAA token endpoint by grant type.",
+		DefBuckets,
+		"grant_type",
+	)
+)
+
+// Handler serves all metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := WriteTo(w); err != nil {
+			logging.Error("error writing metrics", "error", err)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Connections tracks websocket connections. Once hijacked, they are no longer
+// known to the HTTP server and have to be drained separately on shutdown.
+type Connections struct {
+	mu       sync.Mutex
+	conns    map[*connection]struct{}
+	draining bool
+}
+
+// NewConnections returns an empty set of connections.
+func NewConnections() *Connections {
+	return &Connections{
+		conns: map[*connection]struct{}{},
+	}
+}
+
+// Shutdown refuses new connections and waits for the existing ones to be
+// closed. Connections still open when the context is done are closed with a
+// going away close frame and the context's error is returned.
+func (c *Connections) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.draining = true
+	c.mu.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if c.len() == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			c.closeAll()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// accepting reports whether new connections are accepted.
+func (c *Connections) accepting() bool {
+	if c == nil {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.draining
+}
+
+// add tracks the connection unless connections are being drained, in which
+// case it returns false.
+func (c *Connections) add(conn *connection) bool {
+	if c == nil {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.draining {
+		return false
+	}
+
+	c.conns[conn] = struct{}{}
+	return true
+}
+
+func (c *Connections) remove(conn *connection) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.conns, conn)
+}
+
+func (c *Connections) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.conns)
+}
+
+func (c *Connections) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for conn := range c.conns {
+		conn.goAway()
+	}
+}
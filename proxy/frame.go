@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// status code of close frames sent when the proxy shuts down
+const closeGoingAway = 1001
+
+// time allowed to write a close frame to a peer
+const closeFrameTimeout = time.Second
+
+var errFrameWriterClosed = errors.New("websocket connection closed")
+
+// frameWriter writes spliced websocket data to a peer and keeps track of
+// frame boundaries, so that a close frame can be sent without corrupting a
+// frame in transit.
+type frameWriter struct {
+	conn net.Conn
+
+	// frames sent to the backend have to be masked
+	masked bool
+
+	mu     sync.Mutex
+	frames frameTracker
+	closed bool
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, errFrameWriterClosed
+	}
+
+	n, err := w.conn.Write(p)
+	w.frames.feed(p[:n])
+	return n, err
+}
+
+// closeFrame stops forwarding data and sends a close frame with the given
+// status code unless the peer is in the middle of receiving a frame.
+func (w *frameWriter) closeFrame(code uint16) {
+	// unblock writes stuck on a slow peer
+	w.conn.SetWriteDeadline(time.Now().Add(closeFrameTimeout))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return
+	}
+	w.closed = true
+
+	if w.frames.boundary() {
+		w.conn.Write(closeFrame(code, w.masked))
+	}
+}
+
+// closeFrame returns a close frame carrying a status code.
+func closeFrame(code uint16, masked bool) []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+
+	// FIN and close opcode
+	frame := []byte{0x88, byte(len(payload))}
+	if !masked {
+		return append(frame, payload...)
+	}
+
+	frame[1] |= 0x80
+	key := make([]byte, 4)
+	rand.Read(key)
+	frame = append(frame, key...)
+
+	for i, b := range payload {
+		frame = append(frame, b^key[i%4])
+	}
+	return frame
+}
+
+// frameTracker follows the frame headers of a websocket stream.
+type frameTracker struct {
+	// header of the current frame while it is incomplete
+	header []byte
+
+	// payload bytes of the current frame still to come
+	remaining uint64
+}
+
+func (t *frameTracker) feed(p []byte) {
+	for len(p) > 0 {
+		if t.remaining > 0 {
+			n := t.remaining
+			if uint64(len(p)) < n {
+				n = uint64(len(p))
+			}
+			t.remaining -= n
+			p = p[n:]
+			continue
+		}
+
+		t.header = append(t.header, p[0])
+		p = p[1:]
+
+		if n := headerLen(t.header); n > 0 && len(t.header) == n {
+			t.remaining = payloadLen(t.header)
+			t.header = t.header[:0]
+		}
+	}
+}
+
+// boundary reports whether the stream is between two frames.
+func (t *frameTracker) boundary() bool {
+	return len(t.header) == 0 && t.remaining == 0
+}
+
+// headerLen returns the length of a frame header, 0 if unknown yet.
+func headerLen(h []byte) int {
+	if len(h) < 2 {
+		return 0
+	}
+
+	n := 2
+	switch h[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+
+	if h[1]&0x80 != 0 {
+		n += 4
+	}
+
+	return n
+}
+
+func payloadLen(h []byte) uint64 {
+	switch n := h[1] & 0x7f; n {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(h[2:10])
+	default:
+		return uint64(n)
+	}
+}
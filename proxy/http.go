@@ -5,17 +5,95 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strings"
+
+	"github.com/st3v/uaa-proxy/logging"
+	"github.com/st3v/uaa-proxy/metrics"
 )
 
-func HTTP(target *url.URL) http.Handler {
-	return &httputil.ReverseProxy{
+// HTTP proxies requests to the instances of the pool.
+func HTTP(pool *Pool, opts ...Option) http.Handler {
+	o := newOptions(opts)
+
+	proxy := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			req.Host = target.Host
-			req.URL.Host = target.Host
-			req.URL.Scheme = target.Scheme
-			req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
-			req.URL.RawQuery = combinedQuery(target, req.URL)
+			rewrite(req, instanceFromContext(req.Context()).url, o)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			pool.report(instanceFromContext(resp.Request.Context()), failedStatus(resp.StatusCode))
+			return nil
 		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			// requests canceled by the client say nothing about the backend
+			if r.Context().Err() == nil {
+				pool.report(instanceFromContext(r.Context()), true)
+			}
+			backendError(w, r, err)
+		},
+	}
+
+	if o.tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = o.tlsConfig
+		proxy.Transport = transport
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inst, err := pool.pick(r)
+		if err != nil {
+			logging.FromRequest(r).Error("error selecting backend", "error", err)
+			metrics.BackendErrors.Inc()
+			http.Error(w, "no backend available", http.StatusServiceUnavailable)
+			return
+		}
+
+		inst.acquire()
+		defer inst.release()
+
+		proxy.ServeHTTP(w, withInstance(r, inst))
+	})
+}
+
+// backendError responds with a bad gateway error if the backend could not
+// be reached.
+func backendError(w http.ResponseWriter, r *http.Request, err error) {
+	logging.FromRequest(r).Error("error proxying request", "method", r.Method, "path", r.URL.Path, "error", err)
+	metrics.BackendErrors.Inc()
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// rewrite prepares a request to be sent to the given target. It is shared
+// by the HTTP and the websocket proxy.
+func rewrite(req *http.Request, target *url.URL, o *options) {
+	setForwardedHeaders(req)
+
+	if o.stripPrefix != "" {
+		req.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, o.stripPrefix), "/")
+		req.URL.RawPath = ""
+		req.Header.Set("X-Forwarded-Prefix", o.stripPrefix)
+	}
+
+	req.Host = target.Host
+	req.URL.Host = target.Host
+	req.URL.Scheme = target.Scheme
+	req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+	req.URL.RawQuery = combinedQuery(target, req.URL)
+	o.identity.set(req)
+}
+
+// setForwardedHeaders adds the original host and protocol of the request
+// unless they have been set by a load balancer in front of the proxy.
+// X-Forwarded-For is handled separately since the reverse proxy sets it.
+func setForwardedHeaders(req *http.Request) {
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set("X-Forwarded-Proto", proto)
 	}
 }
 
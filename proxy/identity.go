@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/st3v/uaa-proxy/uaa"
+)
+
+// IdentityHeaders names the request headers used to pass the identity of the
+// authenticated user to the backend. Empty names disable the corresponding
+// header.
+type IdentityHeaders struct {
+	User   string
+	Email  string
+	UserID string
+	Groups string
+
+	// ClientCert passes the client certificate that authenticated the
+	// request, formatted like Envoy's X-Forwarded-Client-Cert header.
+	ClientCert string
+
+	// AccessToken forwards the user's access token as bearer token in the
+	// Authorization header.
+	AccessToken bool
+}
+
+// set removes any client-supplied identity headers from the request and adds
+// the headers for the authenticated user stored in the request context.
+func (h IdentityHeaders) set(req *http.Request) {
+	for _, name := range []string{h.User, h.Email, h.UserID, h.Groups, h.ClientCert} {
+		if name != "" {
+			req.Header.Del(name)
+		}
+	}
+
+	if h.AccessToken {
+		req.Header.Del("Authorization")
+		if token, ok := uaa.AccessTokenFromContext(req.Context()); ok {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	if cert, ok := uaa.ClientCertificateFromContext(req.Context()); ok {
+		setHeader(req.Header, h.ClientCert, forwardedClientCert(cert))
+	}
+
+	user, ok := uaa.UserFromContext(req.Context())
+	if !ok {
+		return
+	}
+
+	setHeader(req.Header, h.User, user.Name)
+	setHeader(req.Header, h.Email, user.Email)
+	setHeader(req.Header, h.UserID, user.ID)
+	setHeader(req.Header, h.Groups, strings.Join(user.Scopes, ","))
+}
+
+func setHeader(header http.Header, name, value string) {
+	if name != "" && value != "" {
+		header.Set(name, value)
+	}
+}
+
+// forwardedClientCert returns the hash, subject and subject alternative names
+// of a certificate in the format of Envoy's X-Forwarded-Client-Cert header.
+func forwardedClientCert(cert *x509.Certificate) string {
+	fields := []string{
+		fmt.Sprintf("Hash=%x", sha256.Sum256(cert.Raw)),
+		fmt.Sprintf("Subject=%q", cert.Subject.String()),
+	}
+
+	for _, uri := range cert.URIs {
+		fields = append(fields, "URI="+uri.String())
+	}
+
+	for _, name := range cert.DNSNames {
+		fields = append(fields, "DNS="+name)
+	}
+
+	return strings.Join(fields, ";")
+}
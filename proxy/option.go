@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+)
+
+type options struct {
+	identity  IdentityHeaders
+	tlsConfig *tls.Config
+
+	stripPrefix string
+
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	connections *Connections
+}
+
+// Option configures the behavior of the HTTP and websocket proxies.
+type Option func(o *options)
+
+// WithIdentityHeaders passes the identity of the authenticated user to the
+// backend using the given request headers.
+func WithIdentityHeaders(headers IdentityHeaders) Option {
+	return func(o *options) {
+		o.identity = headers
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used for connections to HTTPS
+// backends.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = config
+	}
+}
+
+// WithStripPrefix removes the given path prefix from requests before they
+// are sent to the backend.
+func WithStripPrefix(prefix string) Option {
+	return func(o *options) {
+		o.stripPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithIdleTimeout closes websocket connections without any traffic for the
+// given duration.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = timeout
+	}
+}
+
+// WithMaxLifetime closes websocket connections after the given duration
+// regardless of their activity.
+func WithMaxLifetime(lifetime time.Duration) Option {
+	return func(o *options) {
+		o.maxLifetime = lifetime
+	}
+}
+
+// WithConnections tracks websocket connections in order to drain them on
+// shutdown.
+func WithConnections(connections *Connections) Option {
+	return func(o *options) {
+		o.connections = connections
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := new(options)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
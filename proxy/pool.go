@@ -0,0 +1,415 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/st3v/uaa-proxy/logging"
+	"github.com/st3v/uaa-proxy/metrics"
+	"github.com/st3v/uaa-proxy/sticky"
+)
+
+// Strategy selects an instance of a pool for a request.
+type Strategy string
+
+// supported strategies
+const (
+	RoundRobin       Strategy = "round-robin"
+	LeastConnections Strategy = "least-connections"
+	CookieAffinity   Strategy = "cookie"
+)
+
+// ParseStrategy parses a strategy name, the empty name selects round-robin.
+func ParseStrategy(name string) (Strategy, error) {
+	switch s := Strategy(name); s {
+	case "":
+		return RoundRobin, nil
+	case RoundRobin, LeastConnections, CookieAffinity:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown strategy %q", name)
+}
+
+// HealthCheck configures active health checks of the instances of a pool.
+// Instances are requested at the given path and considered unhealthy after
+// UnhealthyThreshold consecutive failures, healthy again after
+// HealthyThreshold consecutive successes. Any status other than 2xx fails.
+type HealthCheck struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+// errNoInstance is returned if all instances of a pool are unavailable.
+var errNoInstance = errors.New("no healthy backend instance")
+
+// Pool is a set of backend instances requests are balanced across.
+type Pool struct {
+	name      string
+	instances []*instance
+	strategy  Strategy
+	next      uint32
+
+	// passive ejection
+	maxFails      int
+	ejectDuration time.Duration
+
+	healthCheck *HealthCheck
+	client      *http.Client
+
+	mu     sync.Mutex
+	done   chan struct{}
+	closed bool
+}
+
+// PoolOption configures a pool.
+type PoolOption func(p *Pool)
+
+// WithName names the pool in metrics, usually after its route.
+func WithName(name string) PoolOption {
+	return func(p *Pool) {
+		p.name = name
+	}
+}
+
+// WithStrategy sets the strategy used to select instances.
+func WithStrategy(strategy Strategy) PoolOption {
+	return func(p *Pool) {
+		p.strategy = strategy
+	}
+}
+
+// WithPassiveEjection takes instances out of the pool for the given duration
+// after maxFails consecutive failed requests. Connection errors and 502, 503
+// and 504 responses count as failures.
+func WithPassiveEjection(maxFails int, duration time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.maxFails = maxFails
+		p.ejectDuration = duration
+	}
+}
+
+// WithHealthCheck actively checks the health of all instances using the given
+// client.
+func WithHealthCheck(check HealthCheck, client *http.Client) PoolOption {
+	return func(p *Pool) {
+		p.healthCheck = &check
+		p.client = client
+	}
+}
+
+// NewPool returns a pool of the given backend instances. Active health checks
+// start right away, all instances are considered healthy until checked.
+func NewPool(targets []*url.URL, opts ...PoolOption) (*Pool, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("pool without instances")
+	}
+
+	p := &Pool{strategy: RoundRobin, done: make(chan struct{})}
+	for _, target := range targets {
+		p.instances = append(p.instances, &instance{id: instanceID(target), url: target, healthy: true})
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.healthCheck != nil {
+		if p.client == nil {
+			p.client = http.DefaultClient
+		}
+
+		for _, inst := range p.instances {
+			go p.check(inst)
+		}
+	}
+
+	return p, nil
+}
+
+// Close stops the active health checks of the pool and removes their metrics.
+// Requests can still be served.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+
+	if p.healthCheck != nil {
+		for _, inst := range p.instances {
+			metrics.BackendUp.Delete(p.name, inst.url.Host)
+		}
+	}
+}
+
+// Ready returns an error if no instance is available. Without active health
+// checks instances are dialed instead.
+func (p *Pool) Ready(ctx context.Context) error {
+	if p.healthCheck != nil {
+		if len(p.available()) == 0 {
+			return errNoInstance
+		}
+		return nil
+	}
+
+	var lastErr error
+	for _, inst := range p.instances {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", hostPort(inst.url))
+		if err == nil {
+			return conn.Close()
+		}
+		lastErr = err
+	}
+
+	return lastErr
+}
+
+// pick selects an available instance for the request.
+func (p *Pool) pick(r *http.Request) (*instance, error) {
+	available := p.available()
+	if len(available) == 0 {
+		return nil, errNoInstance
+	}
+
+	switch p.strategy {
+	case LeastConnections:
+		// start at a rotating offset to spread ties
+		offset := int(atomic.AddUint32(&p.next, 1))
+		var best *instance
+		for i := range available {
+			inst := available[(offset+i)%len(available)]
+			if best == nil || inst.connections() < best.connections() {
+				best = inst
+			}
+		}
+		return best, nil
+
+	case CookieAffinity:
+		// prefer the instance recorded in the session cookie
+		if id, ok := sticky.Instance(r); ok {
+			for _, inst := range available {
+				if inst.id == id {
+					return inst, nil
+				}
+			}
+		}
+
+		if session, ok := sticky.ID(r); ok {
+			inst := rendezvous(available, session)
+			sticky.Pin(r, inst.id)
+			return inst, nil
+		}
+	}
+
+	return available[int(atomic.AddUint32(&p.next, 1)-1)%len(available)], nil
+}
+
+func (p *Pool) available() []*instance {
+	now := time.Now()
+	available := make([]*instance, 0, len(p.instances))
+	for _, inst := range p.instances {
+		if inst.available(now) {
+			available = append(available, inst)
+		}
+	}
+	return available
+}
+
+// rendezvous selects the instance with the highest hash for the session, so
+// that sessions only move if their instance becomes unavailable.
+func rendezvous(instances []*instance, session string) *instance {
+	var (
+		best      *instance
+		bestScore uint64
+	)
+
+	for _, inst := range instances {
+		h := fnv.New64a()
+		h.Write([]byte(session))
+		h.Write([]byte(inst.url.String()))
+
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = inst, score
+		}
+	}
+
+	return best
+}
+
+// report records the outcome of a request to an instance for passive
+// ejection.
+func (p *Pool) report(inst *instance, failed bool) {
+	if p.maxFails <= 0 {
+		return
+	}
+
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	if !failed {
+		inst.fails = 0
+		return
+	}
+
+	inst.fails++
+	if inst.fails >= p.maxFails {
+		inst.fails = 0
+		inst.ejectedUntil = time.Now().Add(p.ejectDuration)
+		logging.Warn("ejecting backend instance", "backend", inst.url.Host, "duration", p.ejectDuration)
+	}
+}
+
+// check runs the active health check of an instance until the pool is
+// closed.
+func (p *Pool) check(inst *instance) {
+	hc := p.healthCheck
+	target := *inst.url
+	target.Path = singleJoiningSlash(target.Path, hc.Path)
+
+	successes, failures := 0, 0
+
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		err := probe(p.client, target.String(), hc.Timeout)
+
+		if err != nil {
+			successes, failures = 0, failures+1
+		} else {
+			successes, failures = successes+1, 0
+		}
+
+		inst.mu.Lock()
+		switch {
+		case inst.healthy && failures >= hc.UnhealthyThreshold:
+			inst.healthy = false
+			logging.Warn("backend instance unhealthy", "backend", inst.url.Host, "error", err)
+		case !inst.healthy && successes >= hc.HealthyThreshold:
+			inst.healthy = true
+			logging.Info("backend instance healthy", "backend", inst.url.Host)
+		}
+		healthy := inst.healthy
+		inst.mu.Unlock()
+
+		p.setUp(inst, healthy)
+	}
+}
+
+// setUp records the health of an instance unless the pool has been closed
+// in the meantime.
+func (p *Pool) setUp(inst *instance, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	up := 0.0
+	if healthy {
+		up = 1
+	}
+	metrics.BackendUp.Set(up, p.name, inst.url.Host)
+}
+
+func probe(client *http.Client, url string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// instance is a single backend of a pool.
+type instance struct {
+	id     string
+	url    *url.URL
+	active int64
+
+	mu           sync.Mutex
+	healthy      bool
+	fails        int
+	ejectedUntil time.Time
+}
+
+// instanceID identifies an instance in session cookies without revealing its
+// address.
+func instanceID(target *url.URL) string {
+	sum := sha256.Sum256([]byte(target.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (i *instance) available(now time.Time) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.healthy && !now.Before(i.ejectedUntil)
+}
+
+func (i *instance) connections() int64 {
+	return atomic.LoadInt64(&i.active)
+}
+
+func (i *instance) acquire() {
+	atomic.AddInt64(&i.active, 1)
+}
+
+func (i *instance) release() {
+	atomic.AddInt64(&i.active, -1)
+}
+
+type contextKey int
+
+const instanceContextKey contextKey = 0
+
+func withInstance(r *http.Request, inst *instance) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), instanceContextKey, inst))
+}
+
+func instanceFromContext(ctx context.Context) *instance {
+	inst, _ := ctx.Value(instanceContextKey).(*instance)
+	return inst
+}
+
+// failedStatus reports whether a response status counts as failure for
+// passive ejection.
+func failedStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
@@ -1,63 +1,314 @@
 package proxy
 
 import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/st3v/uaa-proxy/logging"
+	"github.com/st3v/uaa-proxy/metrics"
 	"github.com/st3v/uaa-proxy/util"
 )
 
-func Websocket(target string, fallback http.Handler) http.Handler {
+// Websocket proxies websocket upgrade requests to the instances of the pool,
+// all other requests are passed to the fallback handler. Upgrade requests are
+// rewritten the same way as by the HTTP proxy.
+func Websocket(pool *Pool, fallback http.Handler, opts ...Option) http.Handler {
+	o := newOptions(opts)
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !util.IsWebsocketRequest(r) {
 			fallback.ServeHTTP(w, r)
 			return
 		}
 
-		d, err := net.Dial("tcp", target)
+		if !o.connections.accepting() {
+			http.Error(w, "Shutting down.", http.StatusServiceUnavailable)
+			return
+		}
+
+		inst, err := pool.pick(r)
+		if err != nil {
+			http.Error(w, "No backend available.", http.StatusServiceUnavailable)
+			logging.FromRequest(r).Error("error selecting websocket backend", "error", err)
+			metrics.BackendErrors.Inc()
+			return
+		}
+
+		// open connections count for least-connections balancing
+		inst.acquire()
+		defer inst.release()
+
+		outreq := r.Clone(r.Context())
+		rewrite(outreq, inst.url, o)
+		appendForwardedFor(outreq, r.RemoteAddr)
+
+		d, err := dial(inst.url, o.tlsConfig)
 		if err != nil {
 			http.Error(w, "Error contacting backend server.", 500)
-			log.Printf("error dialing websocket backend %s: %v", target, err)
+			logging.FromRequest(r).Error("error dialing websocket backend", "backend", inst.url.Host, "error", err)
+			metrics.BackendErrors.Inc()
+			pool.report(inst, true)
 			return
 		}
 		defer d.Close()
 
+		err = outreq.Write(d)
+		if err != nil {
+			http.Error(w, "Error contacting backend server.", 500)
+			logging.FromRequest(r).Error("error writing request to websocket backend", "error", err)
+			metrics.BackendErrors.Inc()
+			return
+		}
+
+		br := bufio.NewReader(d)
+		resp, err := http.ReadResponse(br, outreq)
+		if err != nil {
+			http.Error(w, "Error contacting backend server.", 502)
+			logging.FromRequest(r).Error("error reading response from websocket backend", "error", err)
+			metrics.BackendErrors.Inc()
+			pool.report(inst, true)
+			return
+		}
+
+		pool.report(inst, failedStatus(resp.StatusCode))
+
+		// backend refused the upgrade, pass its response on
+		if resp.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+			logging.FromRequest(r).Warn("websocket backend refused upgrade", "status", resp.StatusCode)
+			relay(w, resp)
+			return
+		}
+
 		hj, ok := w.(http.Hijacker)
 		if !ok {
 			http.Error(w, "Not a hijacker?", 500)
 			return
 		}
 
-		nc, _, err := hj.Hijack()
+		nc, buf, err := hj.Hijack()
 		if err != nil {
-			log.Printf("error hijacking request: %v", err)
+			logging.FromRequest(r).Error("error hijacking request", "error", err)
 			return
 		}
 		defer nc.Close()
 
+		c := &connection{
+			client:    nc,
+			backend:   d,
+			toClient:  &frameWriter{conn: nc},
+			toBackend: &frameWriter{conn: d, masked: true},
+			last:      time.Now().UnixNano(),
+		}
+
+		// shutdown may have started since the check above
+		if !o.connections.add(c) {
+			io.WriteString(nc, "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			return
+		}
+		defer o.connections.remove(c)
+
+		// complete the handshake with the client
+		fmt.Fprintf(nc, "HTTP/1.1 %s\r\n", resp.Status)
+		resp.Header.Write(nc)
+		if _, err := io.WriteString(nc, "\r\n"); err != nil {
+			logging.FromRequest(r).Error("error writing upgrade response", "error", err)
+			return
+		}
+
+		metrics.Websockets.Inc()
+		metrics.WebsocketsOpen.Inc()
+		defer metrics.WebsocketsOpen.Dec()
+
+		done := make(chan struct{})
+		defer close(done)
+		go c.expire(o.idleTimeout, o.maxLifetime, done)
+
 		errChan := make(chan error, 2)
 		cp := func(dst io.Writer, src io.Reader) {
-			_, err := io.Copy(dst, src)
+			_, err := io.Copy(dst, &activityReader{src, &c.last})
 			errChan <- err
 		}
 
-		// copy dowstream
-		go cp(d, nc)
+		// copy dowstream, including data the client sent along with the
+		// handshake
+		go cp(c.toBackend, buf.Reader)
 
-		// copy upstream
-		go cp(nc, d)
+		// copy upstream, including data buffered while reading the response
+		go cp(c.toClient, br)
 
-		err = r.Write(d)
-		if err != nil {
-			log.Printf("error writing request to target: %v", err)
+		err = <-errChan
+		if err != nil && !c.expired() {
+			logging.FromRequest(r).Warn("error handling socket", "error", err)
+		}
+	})
+}
+
+// connection is a websocket connection between client and backend.
+type connection struct {
+	client  net.Conn
+	backend net.Conn
+
+	// data is forwarded through frame writers to allow for close frames
+	toClient  *frameWriter
+	toBackend *frameWriter
+
+	// unix time of the last read in nanoseconds
+	last int64
+
+	closed int32
+}
+
+// expire closes the connection after it has been idle for the given time or
+// reached its maximum lifetime. Zero durations disable the respective limit.
+func (c *connection) expire(idle, lifetime time.Duration, done <-chan struct{}) {
+	if idle <= 0 && lifetime <= 0 {
+		return
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		now := time.Now()
+
+		deadline := time.Time{}
+		if lifetime > 0 {
+			deadline = start.Add(lifetime)
+		}
+
+		if idle > 0 {
+			idleDeadline := time.Unix(0, atomic.LoadInt64(&c.last)).Add(idle)
+			if deadline.IsZero() || idleDeadline.Before(deadline) {
+				deadline = idleDeadline
+			}
+		}
+
+		if !now.Before(deadline) {
+			logging.Info("closing expired websocket connection", "age", now.Sub(start).Round(time.Second))
+			c.close()
 			return
 		}
 
-		err = <-errChan
-		if err != nil {
-			log.Printf("error handling socket: %v\n", err)
+		timer.Reset(deadline.Sub(now))
+
+		select {
+		case <-done:
+			return
+		case <-timer.C:
 		}
-	})
+	}
+}
+
+func (c *connection) close() {
+	atomic.StoreInt32(&c.closed, 1)
+	c.client.Close()
+	c.backend.Close()
+}
+
+// goAway sends close frames with status going away to both sides, then
+// closes the connection.
+func (c *connection) goAway() {
+	atomic.StoreInt32(&c.closed, 1)
+	c.toClient.closeFrame(closeGoingAway)
+	c.toBackend.closeFrame(closeGoingAway)
+	c.close()
+}
+
+func (c *connection) expired() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// activityReader records the time of every successful read.
+type activityReader struct {
+	io.Reader
+	last *int64
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(r.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// relay writes a backend response to the client.
+func relay(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	io.Copy(w, resp.Body)
+}
+
+// appendForwardedFor adds the client ip to the X-Forwarded-For header the
+// same way the reverse proxy does for regular requests.
+func appendForwardedFor(req *http.Request, remoteAddr string) {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return
+	}
+
+	if prior := req.Header["X-Forwarded-For"]; len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	req.Header.Set("X-Forwarded-For", ip)
+}
+
+// timeouts used when dialing websocket backends, the same as the ones of the
+// transport proxying regular requests
+const (
+	dialTimeout   = 30 * time.Second
+	dialKeepAlive = 30 * time.Second
+)
+
+// dial connects to the backend, using TLS for https and wss targets.
+func dial(target *url.URL, config *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: dialKeepAlive,
+	}
+
+	switch target.Scheme {
+	case "https", "wss":
+		if config == nil {
+			config = &tls.Config{}
+		}
+
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = target.Hostname()
+		}
+
+		return tls.DialWithDialer(dialer, "tcp", hostPort(target), config)
+	default:
+		return dialer.Dial("tcp", hostPort(target))
+	}
+}
+
+// hostPort returns the host and port of the target, adding the default port
+// of its scheme if the target has none.
+func hostPort(target *url.URL) string {
+	if target.Port() != "" {
+		return target.Host
+	}
+
+	port := "80"
+	if target.Scheme == "https" || target.Scheme == "wss" {
+		port = "443"
+	}
+
+	return net.JoinHostPort(target.Hostname(), port)
 }
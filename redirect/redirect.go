@@ -3,6 +3,8 @@ package redirect
 import (
 	"net"
 	"net/http"
+
+	"github.com/st3v/uaa-proxy/logging"
 )
 
 // ForwardedPort returns a handler that checks if the X-Forwarded-Port header
@@ -17,6 +19,7 @@ func ForwardedPort(port string, handler http.Handler) http.Handler {
 			}
 
 			r.URL.Host = net.JoinHostPort(host, port)
+			logging.FromRequest(r).Debug("redirecting to required port", "forwarded_port", p, "port", port)
 			http.Redirect(w, r, r.URL.String(), http.StatusMovedPermanently)
 			return
 		}
@@ -32,9 +35,30 @@ func ForwardedProto(proto string, handler http.Handler) http.Handler {
 		if p := r.Header.Get("X-Forwarded-Proto"); p != "" && p != proto {
 			r.URL.Host = r.Host
 			r.URL.Scheme = proto
+			logging.FromRequest(r).Debug("redirecting to required protocol", "forwarded_proto", p, "proto", proto)
 			http.Redirect(w, r, r.URL.String(), http.StatusMovedPermanently)
 			return
 		}
 		handler.ServeHTTP(w, r)
 	})
 }
+
+// HTTPS returns a handler that redirects all requests to HTTPS on the given
+// port. The port is omitted from the redirect URL if it is the default port.
+func HTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		r.URL.Host = host
+		r.URL.Scheme = "https"
+		logging.FromRequest(r).Debug("redirecting to HTTPS", "host", host)
+		http.Redirect(w, r, r.URL.String(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/st3v/uaa-proxy/config"
+	"github.com/st3v/uaa-proxy/health"
+	"github.com/st3v/uaa-proxy/logging"
+	"github.com/st3v/uaa-proxy/proxy"
+	"github.com/st3v/uaa-proxy/router"
+	"github.com/st3v/uaa-proxy/uaa"
+
+	"golang.org/x/oauth2"
+)
+
+var errNoBackend = errors.New("must specify backend address, routes file or routes in config file")
+
+// chain builds the handlers proxying requests to the routes. Routes and
+// policy can be reloaded, everything else is fixed at startup.
+type chain struct {
+	oauth         *oauth2.Config
+	session       uaa.Session
+	httpClient    *http.Client
+	uaaOpts       []uaa.Option
+	proxyOpts     []proxy.Option
+	wsOpts        []proxy.Option
+	backendClient *http.Client
+	checker       *health.Checker
+
+	// scopes requested from UAA
+	scopes []string
+
+	// configuration file the chain has been built from
+	file *config.File
+
+	mu      sync.Mutex
+	current atomic.Value
+}
+
+// generation is the handler for a set of routes and a policy.
+type generation struct {
+	handler http.Handler
+	routes  []router.Route
+	pools   []*proxy.Pool
+}
+
+// build returns the handler for the given routes and policy.
+func (c *chain) build(routes []router.Route, policy *uaa.Policy) (*generation, error) {
+	gen := &generation{routes: routes}
+
+	// one pool of backend instances per route
+	for _, route := range routes {
+		targets := []*url.URL{}
+		for _, target := range route.Targets() {
+			// validated when loading the routes
+			u, _ := url.Parse(target)
+			targets = append(targets, u)
+		}
+
+		pool, err := proxy.NewPool(targets, route.PoolOptions(c.backendClient)...)
+		if err != nil {
+			gen.close()
+			return nil, fmt.Errorf("route %q: %v", route.Name, err)
+		}
+		gen.pools = append(gen.pools, pool)
+	}
+
+	// one proxy per route, each with its own authorization requirements
+	handlers := []http.Handler{}
+	for i, route := range routes {
+		opts := c.proxyOpts[:len(c.proxyOpts):len(c.proxyOpts)]
+		if route.StripPrefix {
+			opts = append(opts, proxy.WithStripPrefix(route.Prefix()))
+		}
+
+		// basic HTTP proxy
+		handler := proxy.HTTP(gen.pools[i], opts...)
+
+		// websocket proxy
+		if route.Websockets {
+			handler = proxy.Websocket(gen.pools[i], handler, append(opts, c.wsOpts...)...)
+		}
+
+		// oauth2 authorization handler
+		routeOpts := append(c.uaaOpts[:len(c.uaaOpts):len(c.uaaOpts)], uaa.WithPolicy(routePolicy(policy, route)))
+		handler = uaa.Authorize(c.oauth, c.session, c.httpClient, handler, routeOpts...)
+
+		handlers = append(handlers, handler)
+	}
+
+	gen.handler = router.New(routes, handlers)
+	return gen, nil
+}
+
+// activate atomically replaces the current generation and its readiness
+// checks. Requests in flight finish on the previous generation.
+func (c *chain) activate(gen *generation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prev, _ := c.current.Load().(*generation)
+	if prev != nil {
+		for _, route := range prev.routes {
+			c.checker.Remove(backendCheckName(route, len(prev.routes)))
+		}
+	}
+
+	for i, route := range gen.routes {
+		c.checker.Add(backendCheckName(route, len(gen.routes)), gen.pools[i].Ready)
+	}
+
+	c.current.Store(gen)
+
+	if prev != nil {
+		prev.close()
+	}
+}
+
+// reload rebuilds the chain from the configuration sources, the current
+// generation is kept on errors.
+func (c *chain) reload() error {
+	file := c.file
+	if configFile != "" {
+		var err error
+		if file, err = config.Load(configFile); err != nil {
+			return err
+		}
+
+		for _, name := range c.file.Changed(file) {
+			logging.Warn("ignoring changed setting, restart to apply", "setting", name)
+		}
+	}
+
+	routes, policy, err := loadRoutes(file)
+	if err != nil {
+		return err
+	}
+
+	for _, scope := range routeScopes(routes, policy) {
+		if !contains(c.scopes, scope) {
+			logging.Warn("scope has not been requested from UAA, restart to request it", "scope", scope)
+		}
+	}
+
+	gen, err := c.build(routes, policy)
+	if err != nil {
+		return err
+	}
+
+	c.activate(gen)
+	c.file = file
+
+	logging.Info("reloaded configuration", "routes", len(routes), "rules", len(policy.Rules))
+	return nil
+}
+
+func (c *chain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.current.Load().(*generation).handler.ServeHTTP(w, r)
+}
+
+// close stops the health checks of the generation's pools.
+func (g *generation) close() {
+	for _, pool := range g.pools {
+		pool.Close()
+	}
+}
+
+// loadRoutes returns the routes and the policy given by the config file, the
+// routes and policy files or the backend flag.
+func loadRoutes(file *config.File) ([]router.Route, *uaa.Policy, error) {
+	var routes []router.Route
+
+	switch {
+	case file != nil && file.Routes != nil:
+		if routesFile != "" {
+			return nil, nil, fmt.Errorf("routes must not be given both in %s and routes.file", file.Path)
+		}
+
+		table := &router.Table{Routes: file.Routes}
+		if err := table.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", file.Path, err)
+		}
+		routes = table.Routes
+
+	case routesFile != "":
+		table, err := router.LoadTable(routesFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading routes from %s: %v", routesFile, err)
+		}
+		routes = table.Routes
+
+	case backendAddr != "":
+		routes = []router.Route{{Backend: backendAddr, Websockets: proxyWebsockets}}
+		if err := routes[0].Validate(); err != nil {
+			return nil, nil, fmt.Errorf("invalid backend address: %v", err)
+		}
+
+	default:
+		return nil, nil, errNoBackend
+	}
+
+	// per-path authorization policy
+	policy := new(uaa.Policy)
+
+	switch {
+	case file != nil && file.Policy != nil:
+		if policyFile != "" {
+			return nil, nil, fmt.Errorf("policy must not be given both in %s and policy.file", file.Path)
+		}
+		policy = file.Policy
+
+	case policyFile != "":
+		var err error
+		if policy, err = uaa.LoadPolicy(policyFile); err != nil {
+			return nil, nil, fmt.Errorf("error loading policy from %s: %v", policyFile, err)
+		}
+	}
+
+	return routes, policy, nil
+}
+
+// routeScopes returns all scopes referenced by the policy and the routes.
+func routeScopes(routes []router.Route, policy *uaa.Policy) []string {
+	scopes := policy.Scopes()
+	for _, route := range routes {
+		for _, scope := range route.Scopes {
+			if !contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
@@ -0,0 +1,330 @@
+// Package router dispatches requests to backends based on host name and
+// path prefix.
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/st3v/uaa-proxy/proxy"
+	"github.com/st3v/uaa-proxy/uaa"
+)
+
+// Route maps requests for a host and path prefix to a backend. An empty host
+// matches any host, *.example.com matches a single label. Authorization
+// requirements of the route apply to all paths not covered by the policy.
+//
+// Requests can be balanced across several instances of a backend, given in
+// addition to or instead of a single backend.
+type Route struct {
+	Name        string   `json:"name,omitempty"`
+	Host        string   `json:"host,omitempty"`
+	PathPrefix  string   `json:"path_prefix,omitempty"`
+	Backend     string   `json:"backend,omitempty"`
+	StripPrefix bool     `json:"strip_prefix,omitempty"`
+	Websockets  bool     `json:"websockets,omitempty"`
+	Anonymous   bool     `json:"anonymous,omitempty"`
+	Scopes      []string `json:"scopes,omitempty"`
+	Match       string   `json:"match,omitempty"`
+
+	Backends      []string     `json:"backends,omitempty"`
+	Strategy      string       `json:"strategy,omitempty"`
+	HealthCheck   *HealthCheck `json:"health_check,omitempty"`
+	MaxFails      int          `json:"max_fails,omitempty"`
+	EjectDuration Duration     `json:"eject_duration,omitempty"`
+}
+
+// HealthCheck configures active health checks of the backend instances of a
+// route.
+type HealthCheck struct {
+	Path               string   `json:"path"`
+	Interval           Duration `json:"interval,omitempty"`
+	Timeout            Duration `json:"timeout,omitempty"`
+	HealthyThreshold   int      `json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold,omitempty"`
+}
+
+// Duration is a time.Duration encoded as string like 10s in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\"")
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// defaults of the backend pool settings
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+	defaultEjectDuration       = 30 * time.Second
+)
+
+// Table is the list of routes read from a routes file.
+type Table struct {
+	Routes []Route `json:"routes"`
+}
+
+// LoadTable reads a JSON encoded routing table from a file.
+func LoadTable(file string) (*Table, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	table := new(Table)
+	if err := json.NewDecoder(f).Decode(table); err != nil {
+		return nil, fmt.Errorf("error decoding routes: %v", err)
+	}
+
+	return table, table.Validate()
+}
+
+// Validate checks all routes of the table.
+func (t *Table) Validate() error {
+	if len(t.Routes) == 0 {
+		return fmt.Errorf("no routes")
+	}
+
+	for i, route := range t.Routes {
+		if err := route.Validate(); err != nil {
+			return fmt.Errorf("route %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the route.
+func (r Route) Validate() error {
+	if len(r.Targets()) == 0 {
+		return fmt.Errorf("missing backend")
+	}
+
+	for _, backend := range r.Targets() {
+		u, err := url.Parse(backend)
+		if err != nil {
+			return fmt.Errorf("invalid backend %q: %v", backend, err)
+		}
+
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("backend %q must be an absolute http or https url", backend)
+		}
+	}
+
+	if _, err := proxy.ParseStrategy(r.Strategy); err != nil {
+		return err
+	}
+
+	if r.HealthCheck != nil && !strings.HasPrefix(r.HealthCheck.Path, "/") {
+		return fmt.Errorf("health check path %q must start with /", r.HealthCheck.Path)
+	}
+
+	if r.MaxFails < 0 || r.EjectDuration < 0 {
+		return fmt.Errorf("max_fails and eject_duration must not be negative")
+	}
+
+	if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+		return fmt.Errorf("path prefix %q must start with /", r.PathPrefix)
+	}
+
+	if strings.Contains(strings.TrimPrefix(r.Host, "*."), "*") {
+		return fmt.Errorf("host %q may only contain a leading wildcard", r.Host)
+	}
+
+	if r.Match != "" && r.Match != uaa.MatchAll && r.Match != uaa.MatchAny {
+		return fmt.Errorf("match must be either %q or %q", uaa.MatchAll, uaa.MatchAny)
+	}
+
+	return nil
+}
+
+// Targets returns the URLs of all backend instances of the route.
+func (r Route) Targets() []string {
+	targets := []string{}
+	if r.Backend != "" {
+		targets = append(targets, r.Backend)
+	}
+	return append(targets, r.Backends...)
+}
+
+// PoolOptions returns the load balancing settings of the route, health
+// checks use the given client.
+func (r Route) PoolOptions(client *http.Client) []proxy.PoolOption {
+	// validated when loading the routes
+	strategy, _ := proxy.ParseStrategy(r.Strategy)
+	opts := []proxy.PoolOption{proxy.WithName(r.ID()), proxy.WithStrategy(strategy)}
+
+	if r.MaxFails > 0 {
+		eject := time.Duration(r.EjectDuration)
+		if eject == 0 {
+			eject = defaultEjectDuration
+		}
+		opts = append(opts, proxy.WithPassiveEjection(r.MaxFails, eject))
+	}
+
+	if hc := r.HealthCheck; hc != nil {
+		check := proxy.HealthCheck{
+			Path:               hc.Path,
+			Interval:           time.Duration(hc.Interval),
+			Timeout:            time.Duration(hc.Timeout),
+			HealthyThreshold:   hc.HealthyThreshold,
+			UnhealthyThreshold: hc.UnhealthyThreshold,
+		}
+
+		if check.Interval <= 0 {
+			check.Interval = defaultHealthCheckInterval
+		}
+		if check.Timeout <= 0 {
+			check.Timeout = defaultHealthCheckTimeout
+		}
+		if check.HealthyThreshold <= 0 {
+			check.HealthyThreshold = defaultHealthyThreshold
+		}
+		if check.UnhealthyThreshold <= 0 {
+			check.UnhealthyThreshold = defaultUnhealthyThreshold
+		}
+
+		opts = append(opts, proxy.WithHealthCheck(check, client))
+	}
+
+	return opts
+}
+
+// Rule returns the authorization rule of the route, matching all paths.
+func (r Route) Rule() uaa.Rule {
+	return uaa.Rule{
+		Path:      "/**",
+		Scopes:    r.Scopes,
+		Match:     r.Match,
+		Anonymous: r.Anonymous,
+	}
+}
+
+// ID identifies the route by its name or else by its host and path prefix.
+func (r Route) ID() string {
+	switch {
+	case r.Name != "":
+		return r.Name
+	case r.Host == "" && r.Prefix() == "":
+		return "/"
+	default:
+		return r.Host + r.Prefix()
+	}
+}
+
+// Prefix returns the normalized path prefix of the route, without trailing
+// slash.
+func (r Route) Prefix() string {
+	return strings.TrimSuffix(r.PathPrefix, "/")
+}
+
+// Router dispatches requests to the handler of the best matching route.
+// Routes with exact hosts take precedence over wildcard hosts and routes
+// without host, longer path prefixes over shorter ones.
+type Router struct {
+	entries []entry
+}
+
+type entry struct {
+	route   Route
+	handler http.Handler
+}
+
+// New returns a router for the given routes and their handlers, which must be
+// in the same order.
+func New(routes []Route, handlers []http.Handler) *Router {
+	entries := make([]entry, len(routes))
+	for i := range routes {
+		entries[i] = entry{routes[i], handlers[i]}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].route, entries[j].route
+		if hostRank(a.Host) != hostRank(b.Host) {
+			return hostRank(a.Host) > hostRank(b.Host)
+		}
+		return len(a.Prefix()) > len(b.Prefix())
+	})
+
+	return &Router{entries}
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := requestHost(r)
+
+	for _, e := range rt.entries {
+		if matchHost(e.route.Host, host) && matchPrefix(e.route.Prefix(), r.URL.Path) {
+			e.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+func hostRank(host string) int {
+	switch {
+	case host == "":
+		return 0
+	case strings.HasPrefix(host, "*."):
+		return 1
+	default:
+		return 2
+	}
+}
+
+// requestHost returns the lower-case host of the request without port.
+func requestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+
+	switch {
+	case pattern == "":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		i := strings.Index(host, ".")
+		return i > 0 && host[i:] == pattern[1:]
+	default:
+		return pattern == host
+	}
+}
+
+// matchPrefix matches whole path segments, /api matches /api and /api/v1
+// but not /apis.
+func matchPrefix(prefix, p string) bool {
+	if prefix == "" {
+		return true
+	}
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
@@ -0,0 +1,83 @@
+package sticky
+
+import (
+	"crypto/rand"
+	"io"
+	"net/http"
+)
+
+type options struct {
+	name     string
+	path     string
+	domain   string
+	secure   bool
+	httpOnly bool
+	sameSite http.SameSite
+
+	key      []byte
+	preserve bool
+}
+
+// Option configures the sticky session cookie.
+type Option func(o *options)
+
+// WithCookieName sets the name of the cookie, JSESSIONID by default.
+func WithCookieName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// WithCookieAttributes sets the attributes of the cookie. By default the
+// cookie is valid for all paths, http-only and same-site lax.
+func WithCookieAttributes(path, domain string, secure, httpOnly bool, sameSite http.SameSite) Option {
+	return func(o *options) {
+		o.path = path
+		o.domain = domain
+		o.secure = secure
+		o.httpOnly = httpOnly
+		o.sameSite = sameSite
+	}
+}
+
+// WithSigningKey sets the key used to sign the backend instance recorded in
+// the cookie. All proxy instances have to share the key, a random key is used
+// if none is given.
+func WithSigningKey(key []byte) Option {
+	return func(o *options) {
+		o.key = key
+	}
+}
+
+// WithPreservedBackendCookie leaves cookies of the same name issued by the
+// backend alone, which is the default. Such cookies are never overwritten,
+// requests are balanced based on their value instead. Otherwise the proxy
+// owns the cookie and replaces the backend's.
+func WithPreservedBackendCookie(preserve bool) Option {
+	return func(o *options) {
+		o.preserve = preserve
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		name:     defaultCookieName,
+		path:     "/",
+		httpOnly: true,
+		sameSite: http.SameSiteLaxMode,
+		preserve: true,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if len(o.key) == 0 {
+		o.key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, o.key); err != nil {
+			panic(err)
+		}
+	}
+
+	return o
+}
@@ -1,26 +1,251 @@
 package sticky
 
 import (
+	"bufio"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"io"
+	"net"
 	"net/http"
+	"strings"
 )
 
-const cookieName = "JSESSIONID"
+const defaultCookieName = "JSESSIONID"
+
+type contextKey int
+
+const stateContextKey contextKey = 0
+
+// state is the sticky session of a request.
+type state struct {
+	o *options
+
+	// session id and verified backend instance of the request cookie
+	id       string
+	instance string
+
+	// the request cookie was issued by the proxy
+	ours bool
+
+	// the cookie needs to be set in the response
+	dirty bool
+}
+
+// Session makes sure every client has a sticky session cookie. Handlers can
+// record the backend instance serving the session in the cookie, see Pin.
+func Session(handler http.Handler, opts ...Option) http.Handler {
+	o := newOptions(opts)
 
-func Session(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if _, err := r.Cookie(cookieName); err != nil {
-			http.SetCookie(w, &http.Cookie{
-				Name:  cookieName,
-				Value: newSessionID(),
-			})
+		st := &state{o: o}
+
+		if cookie, err := r.Cookie(o.name); err == nil && cookie.Value != "" {
+			st.id, st.instance, st.ours = o.decode(cookie.Value)
+
+			// a foreign cookie is replaced unless it should be preserved
+			if !st.ours && !o.preserve {
+				st.id = ""
+			}
 		}
-		handler.ServeHTTP(w, r)
+
+		if st.id == "" {
+			st.id = newSessionID()
+			st.ours = true
+			st.dirty = true
+
+			// make the new session visible to downstream handlers
+			setRequestCookie(r, o.name, st.id)
+		}
+
+		cw := &cookieWriter{ResponseWriter: w, st: st}
+		handler.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), stateContextKey, st)))
+		cw.setCookie()
 	})
 }
 
+// ID returns the sticky session id of the request.
+func ID(r *http.Request) (string, bool) {
+	st, ok := r.Context().Value(stateContextKey).(*state)
+	if !ok {
+		return "", false
+	}
+	return st.id, true
+}
+
+// Instance returns the backend instance recorded in the session cookie. Only
+// instances signed by the proxy are returned.
+func Instance(r *http.Request) (string, bool) {
+	st, ok := r.Context().Value(stateContextKey).(*state)
+	if !ok || st.instance == "" {
+		return "", false
+	}
+	return st.instance, true
+}
+
+// Pin records the backend instance serving the session in the cookie.
+// Preserved backend cookies are left unchanged.
+func Pin(r *http.Request, instance string) {
+	st, ok := r.Context().Value(stateContextKey).(*state)
+	if !ok || !st.ours || st.instance == instance {
+		return
+	}
+
+	st.instance = instance
+	st.dirty = true
+}
+
+// encode returns the cookie value for the session, the instance is signed.
+func (o *options) encode(id, instance string) string {
+	if instance == "" {
+		return id
+	}
+
+	payload := id + "." + instance
+	return payload + "." + o.sign(payload)
+}
+
+// decode parses a cookie value. Values that have not been issued by the proxy
+// are returned as session id.
+func (o *options) decode(value string) (id, instance string, ours bool) {
+	parts := strings.Split(value, ".")
+
+	switch {
+	case len(parts) == 1 && len(value) == sessionIDLength:
+		return value, "", true
+	case len(parts) == 3 && hmac.Equal([]byte(parts[2]), []byte(o.sign(parts[0]+"."+parts[1]))):
+		return parts[0], parts[1], true
+	}
+
+	return value, "", false
+}
+
+func (o *options) sign(payload string) string {
+	mac := hmac.New(sha256.New, o.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cookieWriter sets the session cookie right before the response header is
+// written.
+type cookieWriter struct {
+	http.ResponseWriter
+	st      *state
+	written bool
+}
+
+func (w *cookieWriter) setCookie() {
+	if w.written {
+		return
+	}
+	w.written = true
+
+	if !w.st.dirty {
+		return
+	}
+
+	o := w.st.o
+
+	// the backend takes care of the session itself
+	if o.preserve && setsCookie(w.Header(), o.name) {
+		return
+	}
+
+	// otherwise the cookie is ours alone
+	removeSetCookie(w.Header(), o.name)
+
+	http.SetCookie(w.ResponseWriter, &http.Cookie{
+		Name:     o.name,
+		Value:    o.encode(w.st.id, w.st.instance),
+		Path:     o.path,
+		Domain:   o.domain,
+		Secure:   o.secure,
+		HttpOnly: o.httpOnly,
+		SameSite: o.sameSite,
+	})
+}
+
+func (w *cookieWriter) WriteHeader(code int) {
+	w.setCookie()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cookieWriter) Write(b []byte) (int, error) {
+	w.setCookie()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cookieWriter) Flush() {
+	w.setCookie()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *cookieWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	// the hijacking handler writes the response itself
+	w.written = true
+	return hj.Hijack()
+}
+
+// setRequestCookie replaces all request cookies of the given name, other
+// cookies are left as they are.
+func setRequestCookie(r *http.Request, name, value string) {
+	kept := []string{}
+	for _, line := range r.Header["Cookie"] {
+		for _, part := range strings.Split(line, ";") {
+			part = strings.TrimSpace(part)
+			if part == "" || cookieName(part) == name {
+				continue
+			}
+			kept = append(kept, part)
+		}
+	}
+
+	kept = append(kept, (&http.Cookie{Name: name, Value: value}).String())
+	r.Header.Set("Cookie", strings.Join(kept, "; "))
+}
+
+// removeSetCookie drops response cookies of the given name.
+func removeSetCookie(header http.Header, name string) {
+	kept := []string{}
+	for _, line := range header["Set-Cookie"] {
+		if cookieName(line) != name {
+			kept = append(kept, line)
+		}
+	}
+
+	if len(kept) == 0 {
+		header.Del("Set-Cookie")
+		return
+	}
+	header["Set-Cookie"] = kept
+}
+
+func cookieName(s string) string {
+	return strings.TrimSpace(strings.SplitN(s, "=", 2)[0])
+}
+
+func setsCookie(header http.Header, name string) bool {
+	resp := http.Response{Header: header}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// length of encoded session ids
+var sessionIDLength = base64.URLEncoding.EncodedLen(32)
+
 func newSessionID() string {
 	b := make([]byte, 32)
 	if _, err := io.ReadFull(rand.Reader, b); err != nil {
@@ -0,0 +1,233 @@
+// Package tlsconfig builds the TLS configuration of the proxy listener.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/st3v/uaa-proxy/logging"
+)
+
+// CertStore serves TLS certificates loaded from disk. Besides a default
+// certificate, additional certificates can be placed in a directory as pairs
+// of <name>.crt and <name>.key files, they are selected using SNI. All files
+// are reloaded whenever they change on disk.
+type CertStore struct {
+	certFile string
+	keyFile  string
+	sniDir   string
+
+	mu       sync.RWMutex
+	def      *tls.Certificate
+	byName   map[string]*tls.Certificate
+	modTimes map[string]time.Time
+}
+
+// NewCertStore loads the default certificate and all certificates in sniDir,
+// which is optional.
+func NewCertStore(certFile, keyFile, sniDir string) (*CertStore, error) {
+	s := &CertStore{
+		certFile: certFile,
+		keyFile:  keyFile,
+		sniDir:   sniDir,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// GetCertificate returns the certificate matching the server name requested
+// by the client, falls back to the default certificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+
+	// wildcard certificates cover a single label
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+
+	return s.def, nil
+}
+
+// Watch checks the certificate files for changes in the given interval and
+// reloads them if necessary. Errors are logged and the previously loaded
+// certificates stay in use.
+func (s *CertStore) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		changed, err := s.changed()
+		if err != nil {
+			logging.Error("error checking TLS certificates", "error", err)
+			continue
+		}
+
+		if !changed {
+			continue
+		}
+
+		if err := s.load(); err != nil {
+			logging.Error("error reloading TLS certificates", "error", err)
+			continue
+		}
+
+		logging.Info("reloaded TLS certificates")
+	}
+}
+
+// files returns all certificate and key files by certificate file
+func (s *CertStore) files() (map[string]string, error) {
+	files := map[string]string{s.certFile: s.keyFile}
+
+	if s.sniDir == "" {
+		return files, nil
+	}
+
+	certs, err := filepath.Glob(filepath.Join(s.sniDir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cert := range certs {
+		files[cert] = strings.TrimSuffix(cert, ".crt") + ".key"
+	}
+
+	return files, nil
+}
+
+func (s *CertStore) changed() (bool, error) {
+	files, err := s.files()
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	paths := uniquePaths(files)
+	if len(paths) != len(s.modTimes) {
+		return true, nil
+	}
+
+	for _, f := range paths {
+		info, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+
+		if t, ok := s.modTimes[f]; !ok || !t.Equal(info.ModTime()) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// uniquePaths returns all certificate and key files, a combined PEM file
+// holding both is only returned once
+func uniquePaths(files map[string]string) []string {
+	seen := map[string]bool{}
+	paths := []string{}
+	for cert, key := range files {
+		for _, f := range []string{cert, key} {
+			if !seen[f] {
+				seen[f] = true
+				paths = append(paths, f)
+			}
+		}
+	}
+	return paths
+}
+
+func (s *CertStore) load() error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	modTimes := map[string]time.Time{}
+	byName := map[string]*tls.Certificate{}
+	var def *tls.Certificate
+
+	for certFile, keyFile := range files {
+		for _, f := range []string{certFile, keyFile} {
+			info, err := os.Stat(f)
+			if err != nil {
+				return err
+			}
+			modTimes[f] = info.ModTime()
+		}
+
+		cert, err := loadKeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("error loading %s: %v", certFile, err)
+		}
+
+		if certFile == s.certFile {
+			def = cert
+			continue
+		}
+
+		for _, name := range cert.Leaf.DNSNames {
+			byName[strings.ToLower(name)] = cert
+		}
+
+		if len(cert.Leaf.DNSNames) == 0 && cert.Leaf.Subject.CommonName != "" {
+			byName[strings.ToLower(cert.Leaf.Subject.CommonName)] = cert
+		}
+	}
+
+	if def == nil {
+		return errors.New("missing default certificate")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.def = def
+	s.byName = byName
+	s.modTimes = modTimes
+
+	return nil
+}
+
+func loadKeyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
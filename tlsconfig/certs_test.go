@@ -0,0 +1,75 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCombinedPEM writes a self-signed certificate and its key to a single
+// file.
+func writeCombinedPEM(t *testing.T, file string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy.example.com"},
+		DNSNames:     []string{"proxy.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertStoreCombinedPEMUnchanged(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "proxy.pem")
+	writeCombinedPEM(t, file)
+
+	s, err := NewCertStore(file, file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed, err := s.changed(); err != nil || changed {
+		t.Fatalf("unmodified combined PEM file: changed %v, error %v", changed, err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if changed, err := s.changed(); err != nil || !changed {
+		t.Fatalf("modified combined PEM file: changed %v, error %v", changed, err)
+	}
+}
@@ -0,0 +1,95 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Version parses a TLS version like 1.2.
+func Version(v string) (uint16, error) {
+	version, ok := versions[strings.TrimPrefix(strings.ToLower(v), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", v)
+	}
+	return version, nil
+}
+
+// CipherSuites parses a list of cipher suite names as defined in package
+// crypto/tls, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Only suites without
+// known security issues are supported.
+func CipherSuites(names []string) ([]uint16, error) {
+	suites := []uint16{}
+
+	for _, name := range names {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				suites = append(suites, suite.ID)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+	}
+
+	return suites, nil
+}
+
+// Server returns the TLS configuration for a listener serving the
+// certificates of the given store. Empty cipher suites select Go's defaults.
+func Server(certs *CertStore, minVersion string, cipherSuites []string) (*tls.Config, error) {
+	version, err := Version(minVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	suites, err := CipherSuites(cipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     version,
+	}
+
+	if len(suites) > 0 {
+		config.CipherSuites = suites
+	}
+
+	return config, nil
+}
+
+// RequestClientCerts makes the listener ask clients for a certificate that
+// gets verified against the CAs in the given PEM file. Clients without a
+// certificate are still accepted.
+func RequestClientCerts(config *tls.Config, caFile string) error {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("no certificates found in " + caFile)
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+
+	return nil
+}
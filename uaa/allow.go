@@ -0,0 +1,55 @@
+package uaa
+
+import (
+	"strings"
+)
+
+// AllowList restricts access to specific users. If origins are given, users
+// must have been authenticated by one of them. If user ids, emails or email
+// domains are given, users must match at least one of them. An empty list
+// allows everyone.
+type AllowList struct {
+	UserIDs      []string
+	Emails       []string
+	EmailDomains []string
+	Origins      []string
+}
+
+// allows checks whether a user is on the allow list. Emails and email domains
+// are compared case-insensitively.
+func (a *AllowList) allows(user *User) bool {
+	if a == nil {
+		return true
+	}
+
+	if len(a.Origins) > 0 && !contains(a.Origins, user.Origin) {
+		return false
+	}
+
+	if len(a.UserIDs) == 0 && len(a.Emails) == 0 && len(a.EmailDomains) == 0 {
+		return true
+	}
+
+	if user.ID != "" && contains(a.UserIDs, user.ID) {
+		return true
+	}
+
+	email := strings.ToLower(user.Email)
+	if email == "" {
+		return false
+	}
+
+	for _, e := range a.Emails {
+		if strings.ToLower(e) == email {
+			return true
+		}
+	}
+
+	for _, d := range a.EmailDomains {
+		if strings.HasSuffix(email, "@"+strings.ToLower(strings.TrimPrefix(d, "@"))) {
+			return true
+		}
+	}
+
+	return false
+}
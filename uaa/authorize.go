@@ -2,23 +2,53 @@ package uaa
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	gctx "github.com/gorilla/context"
+	"github.com/st3v/uaa-proxy/logging"
+	"github.com/st3v/uaa-proxy/metrics"
 	"github.com/st3v/uaa-proxy/util"
 
 	"golang.org/x/oauth2"
 )
 
-func Authorize(oauth *oauth2.Config, session Session, httpClient *http.Client, handler http.Handler) http.Handler {
+func Authorize(oauth *oauth2.Config, session Session, httpClient *http.Client, handler http.Handler, opts ...Option) http.Handler {
+	o := newOptions(opts)
+
 	return gctx.ClearHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule, hasRule := o.policy.rule(r)
+		if hasRule && rule.Anonymous {
+			// no login required
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		// machine clients might authenticate with a certificate
+		if len(o.clientCerts) > 0 {
+			if cert, ok := clientCertificate(r); ok {
+				if allowsCertificate(o.clientCerts, cert) {
+					authorizeClientCert(w, r, cert, rule, o, handler)
+					return
+				}
+				logging.FromRequest(r).Warn("client certificate not on allow list", "subject", cert.Subject)
+			}
+		}
+
+		// API clients might present a token instead of a session
+		if o.bearerValidator != nil {
+			if raw, ok := bearerToken(r); ok {
+				authorizeBearer(w, r, raw, rule, oauth, o, handler)
+				return
+			}
+		}
+
 		tval, ok := session.Get(r, sessionKeyToken).(oauth2.Token)
 		if !ok {
 			// no token, go and get one
-			log.Println("no or invalid token in session")
-			redirectToAuthCodeURL(w, r, oauth, session)
+			logging.FromRequest(r).Debug("no or invalid token in session")
+			redirectToAuthCodeURL(w, r, oauth, session, o)
 			return
 		}
 		token := &tval
@@ -31,20 +61,40 @@ func Authorize(oauth *oauth2.Config, session Session, httpClient *http.Client, h
 		// remember token in order to detect refreshs
 		oldAccessToken := token.AccessToken
 
+		// an expired token gets refreshed if possible
+		refresh := !token.Valid() && token.RefreshToken != ""
+
 		// make sure token is valid, refresh if necessary
 		var err error
+		start := time.Now()
 		token, err = oauth.TokenSource(ctx, token).Token()
+		if refresh {
+			metrics.TokenRequestDuration.Observe(time.Since(start).Seconds(), "refresh_token")
+		}
 		if err != nil {
-			log.Printf("error getting token from token source: %v\n", err)
-			redirectToAuthCodeURL(w, r, oauth, session)
+			if refresh {
+				metrics.TokenRefreshes.Inc("failure")
+			}
+			logging.FromRequest(r).Warn("error getting token from token source", "error", err)
+			redirectToAuthCodeURL(w, r, oauth, session, o)
 			return
 		}
 
 		// has token been refreshed?
 		if oldAccessToken != token.AccessToken {
+			metrics.TokenRefreshes.Inc("success")
+
+			// verify refreshed token
+			claims, err := tokenClaims(token, o.tokenVerifier)
+			if err != nil {
+				logging.FromRequest(r).Warn("error verifying refreshed token", "error", err)
+				redirectToAuthCodeURL(w, r, oauth, session, o)
+				return
+			}
+
 			// check token scopes
-			if !hasRequiredScopes(token, oauth.Scopes) {
-				log.Println("insufficient scopes")
+			if !hasRequiredScopes(claims.Scopes(), o.requiredScopes) {
+				logging.FromRequest(r).Warn("insufficient scopes")
 				http.Error(w, "insufficient permissions", http.StatusUnauthorized)
 				return
 			}
@@ -53,35 +103,70 @@ func Authorize(oauth *oauth2.Config, session Session, httpClient *http.Client, h
 			if err := session.Set(w, r, sessionKeyToken, token); err != nil {
 				// just log it for now and move on
 				// next request should trigger re-authentication
-				log.Printf("error storing token in session: %v\n", err)
+				logging.FromRequest(r).Error("error storing token in session", "error", err)
 			}
+
+			// scopes might have changed
+			if user, ok := session.Get(r, sessionKeyUser).(User); ok {
+				user.Scopes = claims.Scopes()
+				if err := session.Set(w, r, sessionKeyUser, user); err != nil {
+					logging.FromRequest(r).Error("error storing user in session", "error", err)
+				}
+			}
+		}
+
+		uval, ok := session.Get(r, sessionKeyUser).(User)
+		if !ok {
+			// session predates user tracking, log in again
+			logging.FromRequest(r).Debug("no or invalid user in session")
+			redirectToAuthCodeURL(w, r, oauth, session, o)
+			return
 		}
+		user := &uval
+
+		// check whether user is allowed at all
+		if !o.allowList.allows(user) {
+			logging.FromRequest(r).Warn("user not on allow list", "user", user.Name, "user_id", user.ID)
+			renderForbidden(w, user)
+			return
+		}
+
+		// check scopes required for the requested path
+		if hasRule && !rule.allows(user.Scopes) {
+			logging.FromRequest(r).Info("insufficient scopes", "method", r.Method, "path", r.URL.Path, "user_id", user.ID)
+			http.Error(w, "insufficient permissions", http.StatusForbidden)
+			return
+		}
+
+		// make user and token available to downstream handlers
+		r = withIdentity(r, user, token)
 
 		handler.ServeHTTP(w, r)
 	}))
 }
 
-func hasRequiredScopes(token *oauth2.Token, scopes []string) bool {
-	str, ok := token.Extra("scope").(string)
-	if !ok {
-		return false
-	}
-
-	// uaa returns scopes a space-separated sting
-	have := strings.Split(str, " ")
-
-	contains := func(haystack []string, needle string) bool {
-		for _, h := range haystack {
-			// scopes are case-sensitive
-			if h == needle {
-				return true
-			}
+// tokenClaims returns the claims of an access token. If a token verifier is
+// configured, the token gets verified first. Otherwise only the scopes
+// returned by the token endpoint are known.
+func tokenClaims(token *oauth2.Token, verifier *TokenVerifier) (Claims, error) {
+	if verifier == nil {
+		str, _ := token.Extra("scope").(string)
+
+		// uaa returns scopes a space-separated sting
+		scopes := []interface{}{}
+		for _, scope := range strings.Fields(str) {
+			scopes = append(scopes, scope)
 		}
-		return false
+
+		return Claims{"scope": scopes}, nil
 	}
 
-	for _, want := range scopes {
-		if !contains(have, want) {
+	return verifier.Verify(token.AccessToken)
+}
+
+func hasRequiredScopes(have, want []string) bool {
+	for _, w := range want {
+		if !contains(have, w) {
 			return false
 		}
 	}
@@ -89,30 +174,71 @@ func hasRequiredScopes(token *oauth2.Token, scopes []string) bool {
 	return true
 }
 
-func redirectToAuthCodeURL(w http.ResponseWriter, r *http.Request, oauth *oauth2.Config, session Session) {
+func contains(haystack []string, needle string) bool {
+	for _, h := range haystack {
+		// scopes are case-sensitive
+		if h == needle {
+			return true
+		}
+	}
+	return false
+}
+
+func redirectToAuthCodeURL(w http.ResponseWriter, r *http.Request, oauth *oauth2.Config, session Session, o *options) {
 	// no need to redirect for websockets or xhr
 	if util.IsWebsocketRequest(r) || util.IsXMLHTTPRequest(r) {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// remember random state string in session
-	state := util.RandomString(64)
-	if err := session.Set(w, r, sessionKeyState, state); err != nil {
-		// no need to redirect, callback handler will fail anyway
-		log.Printf("error storing state string in session: %v\n", err)
-		http.Error(w, "error storing session", http.StatusInternalServerError)
+	state, err := randomURLString(32)
+	if err != nil {
+		logging.FromRequest(r).Error("error generating state string", "error", err)
+		http.Error(w, "error generating state", http.StatusInternalServerError)
+		return
+	}
+
+	// the PKCE code challenge is sent along with the redirect, the verifier
+	// will be presented during token exchange
+	verifier, err := newCodeVerifier()
+	if err != nil {
+		logging.FromRequest(r).Error("error generating code verifier", "error", err)
+		http.Error(w, "error generating code verifier", http.StatusInternalServerError)
 		return
 	}
 
-	// remember request url to redirect to after token exchange
-	if err := session.Set(w, r, sessionKeyRedirect, r.URL.String()); err != nil {
-		log.Printf("error storing redirect url in session: %v\n", err)
+	auth := pendingAuth{
+		// request url to redirect to after token exchange, always relative,
+		// even for absolute-form requests
+		Redirect:     r.URL.RequestURI(),
+		CodeVerifier: verifier,
+	}
+
+	opts := append([]oauth2.AuthCodeOption{oauth2.AccessTypeOnline}, codeChallengeOptions(verifier)...)
+
+	// nonce to verify the id_token against
+	if o.oidcVerifier != nil {
+		auth.Nonce, err = newNonce()
+		if err != nil {
+			logging.FromRequest(r).Error("error generating nonce", "error", err)
+			http.Error(w, "error generating nonce", http.StatusInternalServerError)
+			return
+		}
+
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", auth.Nonce))
+	}
+
+	// remember authorization request by state, users might start several
+	// logins concurrently
+	if err := session.SetPending(w, r, callbackPath(oauth), state, auth); err != nil {
+		// no need to redirect, callback handler will fail anyway
+		logging.FromRequest(r).Error("error storing pending authorization in session", "error", err)
 		http.Error(w, "error storing session", http.StatusInternalServerError)
 		return
 	}
 
-	// redirect including including the state string
-	url := oauth.AuthCodeURL(state, oauth2.AccessTypeOnline)
+	// redirect including the state string, the code challenge and the nonce
+	url := oauth.AuthCodeURL(state, opts...)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	metrics.LoginRedirects.Inc()
 }
@@ -0,0 +1,54 @@
+package uaa
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/st3v/uaa-proxy/logging"
+
+	"golang.org/x/oauth2"
+)
+
+// bearerToken returns the token of a bearer Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") || parts[1] == "" {
+		return "", false
+	}
+	return strings.TrimSpace(parts[1]), true
+}
+
+// authorizeBearer validates a bearer token presented by an API client and
+// applies the same checks as for users with a session. No session is
+// created, the request is forwarded as is.
+func authorizeBearer(w http.ResponseWriter, r *http.Request, raw string, rule *Rule, oauth *oauth2.Config, o *options, handler http.Handler) {
+	claims, err := o.bearerValidator.Verify(raw)
+	if err != nil {
+		logging.FromRequest(r).Info("invalid bearer token", "error", err)
+		bearerError(w, http.StatusUnauthorized, "invalid_token")
+		return
+	}
+
+	user := userFromClaims(claims)
+
+	if !hasRequiredScopes(user.Scopes, o.requiredScopes) || (rule != nil && !rule.allows(user.Scopes)) {
+		logging.FromRequest(r).Info("insufficient scopes", "method", r.Method, "path", r.URL.Path, "user_id", user.ID)
+		bearerError(w, http.StatusForbidden, "insufficient_scope")
+		return
+	}
+
+	if !o.allowList.allows(user) {
+		logging.FromRequest(r).Warn("user not on allow list", "user", user.Name, "user_id", user.ID)
+		bearerError(w, http.StatusForbidden, "insufficient_scope")
+		return
+	}
+
+	handler.ServeHTTP(w, withIdentity(r, user, &oauth2.Token{AccessToken: raw}))
+}
+
+// bearerError responds with an error as described in RFC 6750.
+func bearerError(w http.ResponseWriter, code int, err string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=%q", err))
+	http.Error(w, err, code)
+}
@@ -1,49 +1,123 @@
 package uaa
 
 import (
-	"context"
-	"log"
 	"net/http"
 
 	gctx "github.com/gorilla/context"
+	"github.com/st3v/uaa-proxy/logging"
+	"github.com/st3v/uaa-proxy/metrics"
 
 	"golang.org/x/oauth2"
 )
 
-func Callback(oauth *oauth2.Config, session Session, httpClient *http.Client) http.Handler {
+func Callback(oauth *oauth2.Config, session Session, httpClient *http.Client, opts ...Option) http.Handler {
+	o := newOptions(opts)
+
 	return gctx.ClearHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// get state string from session
-		state, ok := session.Get(r, sessionKeyState).(string)
+		// look up the pending authorization request by state, the request is
+		// completed either way
+		auth, ok := session.TakePending(w, r, callbackPath(oauth), r.FormValue("state"))
 		if !ok {
-			log.Println("missing or invalid state")
+			logging.FromRequest(r).Warn("unknown or expired state", "state", r.FormValue("state"))
 			http.Error(w, "missing or invalid state", http.StatusForbidden)
+			metrics.Callbacks.Inc("state_mismatch")
 			return
 		}
 
-		// verify state string in request values
-		if r.FormValue("state") != state {
-			log.Printf("state mismatch, want: %q, have %q\n", state, r.FormValue("state"))
-			http.Error(w, "state mismatch", http.StatusForbidden)
+		// redirect to the original request url after login, it doubles as
+		// retry url for error pages
+		redirectURL := safeRedirect(auth.Redirect, o.redirectHosts, o.defaultRedirect)
+
+		// UAA redirects with an error if the user denied access or if the
+		// authorization request was invalid
+		if code := r.FormValue("error"); code != "" {
+			description := r.FormValue("error_description")
+			logging.FromRequest(r).Warn("authorization failed", "error", code, "description", description)
+
+			renderError(w, o.errorTemplate, ErrorPage{
+				Status:      oauthErrorStatus(code),
+				Error:       code,
+				Description: description,
+				RetryURL:    redirectURL,
+			})
+			metrics.Callbacks.Inc("oauth_error")
 			return
 		}
 
-		ctx := r.Context()
-		if httpClient != nil {
-			ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+		if r.FormValue("code") == "" {
+			logging.FromRequest(r).Warn("missing authorization code")
+			http.Error(w, "missing authorization code", http.StatusBadRequest)
+			metrics.Callbacks.Inc("missing_code")
+			return
+		}
+
+		// PKCE code verifier
+		verifier := auth.CodeVerifier
+		if verifier == "" && o.pkceRequired {
+			logging.FromRequest(r).Warn("missing or invalid code verifier")
+			http.Error(w, "missing or invalid code verifier", http.StatusForbidden)
+			metrics.Callbacks.Inc("missing_verifier")
+			return
 		}
 
 		// exchange auth code for token
-		token, err := oauth.Exchange(ctx, r.FormValue("code"))
+		token, err := exchange(r.Context(), oauth, httpClient, r.FormValue("code"), verifier)
 		if err != nil {
-			log.Printf("error exchanging token: %v\n", err)
-			http.Error(w, "error exchanging token", http.StatusInternalServerError)
+			logging.FromRequest(r).Error("error exchanging token", "error", err)
+			renderError(w, o.errorTemplate, ErrorPage{
+				Status:      http.StatusInternalServerError,
+				Error:       "server_error",
+				Description: "error exchanging token",
+				RetryURL:    redirectURL,
+			})
+			metrics.Callbacks.Inc("exchange_error")
+			return
+		}
+
+		// verify token
+		claims, err := tokenClaims(token, o.tokenVerifier)
+		if err != nil {
+			logging.FromRequest(r).Warn("error verifying token", "error", err)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			metrics.Callbacks.Inc("invalid_token")
 			return
 		}
 
 		// check token scopes
-		if !hasRequiredScopes(token, oauth.Scopes) {
-			log.Println("insufficient scopes")
+		if !hasRequiredScopes(claims.Scopes(), o.requiredScopes) {
+			logging.FromRequest(r).Warn("insufficient scopes")
 			http.Error(w, "insufficient permissions", http.StatusUnauthorized)
+			metrics.Callbacks.Inc("insufficient_scope")
+			return
+		}
+
+		user := userFromClaims(claims)
+
+		// verify id_token, its claims take precedence
+		if o.oidcVerifier != nil {
+			user, err = verifyIDToken(token, o.oidcVerifier, auth.Nonce)
+			if err != nil {
+				logging.FromRequest(r).Warn("error verifying id_token", "error", err)
+				http.Error(w, "invalid id_token", http.StatusUnauthorized)
+				metrics.Callbacks.Inc("invalid_token")
+				return
+			}
+			user.Scopes = claims.Scopes()
+		}
+
+		// check whether user is allowed at all
+		if !o.allowList.allows(user) {
+			logging.FromRequest(r).Warn("user not on allow list", "user", user.Name, "user_id", user.ID)
+			renderForbidden(w, user)
+			metrics.Callbacks.Inc("forbidden")
+			return
+		}
+
+		// remember user in session
+		if err := session.Set(w, r, sessionKeyUser, *user); err != nil {
+			logging.FromRequest(r).Error("error storing user in session", "error", err)
+			http.Error(w, "error storing session", http.StatusInternalServerError)
+			metrics.Callbacks.Inc("session_error")
 			return
 		}
 
@@ -51,17 +125,30 @@ func Callback(oauth *oauth2.Config, session Session, httpClient *http.Client) ht
 		if err := session.Set(w, r, sessionKeyToken, token); err != nil {
 			// just log it for now and move on
 			// next request should trigger re-authentication
-			log.Printf("error storing token in session: %v\n", err)
+			logging.FromRequest(r).Error("error storing token in session", "error", err)
 		}
 
-		// redirect to original request URL
-		redirectURL, ok := session.Get(r, sessionKeyRedirect).(string)
-		if !ok {
-			log.Println("missing or invalid redirect url")
-			http.Error(w, "missing redirect url", http.StatusForbidden)
-			return
-		}
+		logging.SetUserID(r.Context(), user.ID)
+		logging.FromRequest(r).Info("user logged in", "user", user.Name, "user_id", user.ID, "origin", user.Origin)
 
 		http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
+		metrics.Callbacks.Inc("success")
 	}))
 }
+
+// oauthErrorStatus maps the error codes of RFC 6749 section 4.1.2.1 to the
+// status code of the error page shown to the user.
+func oauthErrorStatus(code string) int {
+	switch code {
+	case "access_denied", "invalid_scope":
+		return http.StatusForbidden
+	case "server_error":
+		return http.StatusBadGateway
+	case "temporarily_unavailable":
+		return http.StatusServiceUnavailable
+	}
+
+	// invalid_request, unauthorized_client, unsupported_response_type and
+	// anything unknown indicate a misconfiguration of the proxy
+	return http.StatusInternalServerError
+}
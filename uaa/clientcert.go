@@ -0,0 +1,96 @@
+package uaa
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"strings"
+
+	"github.com/st3v/uaa-proxy/logging"
+
+	"golang.org/x/oauth2"
+)
+
+// ClientCertificateFromContext returns the client certificate that
+// authenticated the request, stored in the request context by the Authorize
+// handler.
+func ClientCertificateFromContext(ctx context.Context) (*x509.Certificate, bool) {
+	cert, ok := ctx.Value(clientCertContextKey).(*x509.Certificate)
+	return cert, ok
+}
+
+// clientCertificate returns the client certificate of a TLS connection if it
+// has been verified against the configured CAs.
+func clientCertificate(r *http.Request) (*x509.Certificate, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return r.TLS.VerifiedChains[0][0], true
+}
+
+// allowsCertificate checks whether the subject common name or one of the
+// subject alternative names of the certificate is allowed. DNS names and
+// emails are compared case-insensitively.
+func allowsCertificate(allowed []string, cert *x509.Certificate) bool {
+	for _, a := range allowed {
+		if cert.Subject.CommonName != "" && a == cert.Subject.CommonName {
+			return true
+		}
+
+		for _, uri := range cert.URIs {
+			if a == uri.String() {
+				return true
+			}
+		}
+
+		for _, name := range append(cert.DNSNames, cert.EmailAddresses...) {
+			if strings.EqualFold(a, name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// authorizeClientCert forwards requests authenticated by an allowed client
+// certificate and applies the same checks as for bearer tokens. Certificates
+// carry no scopes, globally required scopes and rules requiring scopes deny
+// access.
+func authorizeClientCert(w http.ResponseWriter, r *http.Request, cert *x509.Certificate, rule *Rule, o *options, handler http.Handler) {
+	user := userFromCertificate(cert)
+
+	if !hasRequiredScopes(user.Scopes, o.requiredScopes) || (rule != nil && !rule.allows(user.Scopes)) {
+		logging.FromRequest(r).Info("insufficient scopes", "method", r.Method, "path", r.URL.Path, "user_id", user.ID)
+		http.Error(w, "insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	if !o.allowList.allows(user) {
+		logging.FromRequest(r).Warn("client certificate not on user allow list", "user", user.Name, "user_id", user.ID)
+		http.Error(w, "insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	r = withIdentity(r, user, &oauth2.Token{})
+	r = r.WithContext(context.WithValue(r.Context(), clientCertContextKey, cert))
+
+	handler.ServeHTTP(w, r)
+}
+
+func userFromCertificate(cert *x509.Certificate) *User {
+	user := &User{
+		ID:   cert.Subject.String(),
+		Name: cert.Subject.CommonName,
+	}
+
+	if user.Name == "" && len(cert.DNSNames) > 0 {
+		user.Name = cert.DNSNames[0]
+	}
+
+	if len(cert.EmailAddresses) > 0 {
+		user.Email = cert.EmailAddresses[0]
+	}
+
+	return user
+}
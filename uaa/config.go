@@ -1,19 +1,23 @@
 package uaa
 
 import (
-	"fmt"
-
 	"golang.org/x/oauth2"
 )
 
-func Config(url, clientID, clientSecret string, scopes []string, callbackURL string) *oauth2.Config {
+func Config(provider *Provider, clientID, clientSecret string, scopes []string, callbackURL string) *oauth2.Config {
+	// public clients have no secret and must send their client id as part of
+	// the request body when refreshing tokens
+	if clientSecret == "" {
+		oauth2.RegisterBrokenAuthHeaderProvider(provider.TokenURL)
+	}
+
 	return &oauth2.Config{
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
 		Scopes:       scopes,
 		Endpoint: oauth2.Endpoint{
-			AuthURL:  fmt.Sprintf("%s/oauth/authorize", url),
-			TokenURL: fmt.Sprintf("%s/oauth/token", url),
+			AuthURL:  provider.AuthURL,
+			TokenURL: provider.TokenURL,
 		},
 		RedirectURL: callbackURL,
 	}
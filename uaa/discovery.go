@@ -0,0 +1,62 @@
+package uaa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Provider describes the endpoints of a UAA server as published in its
+// OpenID Connect discovery document.
+type Provider struct {
+	Issuer      string `json:"issuer"`
+	AuthURL     string `json:"authorization_endpoint"`
+	TokenURL    string `json:"token_endpoint"`
+	KeysURL     string `json:"jwks_uri"`
+	UserInfoURL string `json:"userinfo_endpoint"`
+}
+
+// Discover fetches the OpenID Connect discovery document of the UAA server
+// at the given url.
+func Discover(url string, httpClient *http.Client) (*Provider, error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	wellKnown := fmt.Sprintf("%s/.well-known/openid-configuration", strings.TrimSuffix(url, "/"))
+
+	resp, err := httpClient.Get(wellKnown)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching discovery document: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching discovery document: %s", resp.Status)
+	}
+
+	provider := new(Provider)
+	if err := json.NewDecoder(resp.Body).Decode(provider); err != nil {
+		return nil, fmt.Errorf("error decoding discovery document: %v", err)
+	}
+
+	if provider.AuthURL == "" || provider.TokenURL == "" {
+		return nil, fmt.Errorf("discovery document is missing authorization or token endpoint")
+	}
+
+	return provider, nil
+}
+
+// DefaultProvider returns the endpoints UAA uses unless configured otherwise.
+// It serves as fallback for servers that do not support discovery.
+func DefaultProvider(url string) *Provider {
+	url = strings.TrimSuffix(url, "/")
+	return &Provider{
+		Issuer:      fmt.Sprintf("%s/oauth/token", url),
+		AuthURL:     fmt.Sprintf("%s/oauth/authorize", url),
+		TokenURL:    fmt.Sprintf("%s/oauth/token", url),
+		KeysURL:     fmt.Sprintf("%s/token_keys", url),
+		UserInfoURL: fmt.Sprintf("%s/userinfo", url),
+	}
+}
@@ -0,0 +1,99 @@
+package uaa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/st3v/uaa-proxy/metrics"
+
+	"golang.org/x/oauth2"
+)
+
+// exchange converts an authorization code into a token. Contrary to
+// oauth2.Config.Exchange it allows to present a PKCE code verifier. Public
+// clients, i.e. clients without a secret, send their client id as part of
+// the request body instead of using basic auth.
+func exchange(ctx context.Context, oauth *oauth2.Config, httpClient *http.Client, code, verifier string) (*oauth2.Token, error) {
+	v := url.Values{
+		"grant_type": {"authorization_code"},
+		"code":       {code},
+	}
+
+	if oauth.RedirectURL != "" {
+		v.Set("redirect_uri", oauth.RedirectURL)
+	}
+
+	if verifier != "" {
+		v.Set("code_verifier", verifier)
+	}
+
+	if oauth.ClientSecret == "" {
+		v.Set("client_id", oauth.ClientID)
+	}
+
+	req, err := http.NewRequest("POST", oauth.Endpoint.TokenURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if oauth.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(oauth.ClientID), url.QueryEscape(oauth.ClientSecret))
+	}
+
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	start := time.Now()
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	metrics.TokenRequestDuration.Observe(time.Since(start).Seconds(), "authorization_code")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch token: %v", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("cannot fetch token: %v\nResponse: %s", resp.Status, body)
+	}
+
+	return parseToken(body)
+}
+
+// parseToken turns the JSON response of the token endpoint into an
+// oauth2.Token. All response fields are made available as token extras.
+func parseToken(body []byte) (*oauth2.Token, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("cannot parse token response: %v", err)
+	}
+
+	token := &oauth2.Token{}
+	token.AccessToken, _ = raw["access_token"].(string)
+	token.TokenType, _ = raw["token_type"].(string)
+	token.RefreshToken, _ = raw["refresh_token"].(string)
+
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("server response missing access_token")
+	}
+
+	if expiresIn, ok := raw["expires_in"].(float64); ok && expiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+
+	return token.WithExtra(raw), nil
+}
@@ -0,0 +1,166 @@
+package uaa
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum number of cached introspection results
+const maxIntrospectionCacheSize = 10000
+
+// TokenValidator validates a raw token and returns its claims.
+type TokenValidator interface {
+	Verify(raw string) (Claims, error)
+}
+
+type introspectionResult struct {
+	claims  Claims
+	expires time.Time
+}
+
+// TokenIntrospector validates tokens using UAA's /check_token endpoint.
+// Results are cached for a short time to avoid a round trip to UAA for every
+// request.
+type TokenIntrospector struct {
+	url          string
+	clientID     string
+	clientSecret string
+	audience     string
+	cacheTTL     time.Duration
+	httpClient   *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]introspectionResult
+}
+
+// NewTokenIntrospector returns an introspector that authenticates against the
+// check token endpoint using the given client credentials. The client needs
+// the uaa.resource authority. An empty audience disables the audience check.
+func NewTokenIntrospector(checkTokenURL, clientID, clientSecret, audience string, cacheTTL time.Duration, httpClient *http.Client) *TokenIntrospector {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &TokenIntrospector{
+		url:          checkTokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		audience:     audience,
+		cacheTTL:     cacheTTL,
+		httpClient:   httpClient,
+		cache:        map[[sha256.Size]byte]introspectionResult{},
+	}
+}
+
+// Verify returns the claims of an active token.
+func (t *TokenIntrospector) Verify(raw string) (Claims, error) {
+	key := sha256.Sum256([]byte(raw))
+
+	if claims, ok := t.cached(key); ok {
+		return claims, nil
+	}
+
+	claims, err := t.introspect(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.audience != "" && !contains(claims.Strings("aud"), t.audience) {
+		return nil, fmt.Errorf("token not intended for audience %q", t.audience)
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+
+	expires := time.Now().Add(t.cacheTTL)
+	if e := time.Unix(int64(exp), 0); e.Before(expires) {
+		expires = e
+	}
+
+	t.store(key, introspectionResult{claims, expires})
+	return claims, nil
+}
+
+func (t *TokenIntrospector) cached(key [sha256.Size]byte) (Claims, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result, ok := t.cache[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(result.expires) {
+		delete(t.cache, key)
+		return nil, false
+	}
+
+	return result.claims, true
+}
+
+func (t *TokenIntrospector) store(key [sha256.Size]byte, result introspectionResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.cache) >= maxIntrospectionCacheSize {
+		now := time.Now()
+		for k, r := range t.cache {
+			if now.After(r.expires) {
+				delete(t.cache, k)
+			}
+		}
+	}
+
+	// still full, start over
+	if len(t.cache) >= maxIntrospectionCacheSize {
+		t.cache = map[[sha256.Size]byte]introspectionResult{}
+	}
+
+	t.cache[key] = result
+}
+
+func (t *TokenIntrospector) introspect(raw string) (Claims, error) {
+	body := url.Values{"token": {raw}}.Encode()
+
+	req, err := http.NewRequest("POST", t.url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(t.clientID), url.QueryEscape(t.clientSecret))
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error checking token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error checking token: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid token: %s: %s", resp.Status, data)
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("error decoding check token response: %v", err)
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,184 @@
+package uaa
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// minimum time between two consecutive fetches of the token keys, prevents
+// tokens with made-up key ids from hammering UAA
+const minKeyRefreshInterval = 30 * time.Second
+
+// jsonWebKey is a single key as returned by UAA's /token_keys endpoint.
+type jsonWebKey struct {
+	Kty   string `json:"kty"`
+	Kid   string `json:"kid"`
+	Use   string `json:"use"`
+	N     string `json:"n"`
+	E     string `json:"e"`
+	Value string `json:"value"`
+}
+
+// keySet caches the public keys used by UAA to sign tokens. Keys are fetched
+// lazily and re-fetched whenever a token references an unknown key id.
+type keySet struct {
+	url        string
+	httpClient *http.Client
+
+	// serializes fetches without blocking lookups of cached keys
+	fetchMu sync.Mutex
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	lastFetched time.Time
+}
+
+func newKeySet(url string, httpClient *http.Client) *keySet {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &keySet{
+		url:        url,
+		httpClient: httpClient,
+		keys:       map[string]*rsa.PublicKey{},
+	}
+}
+
+// key returns the public key for a given key id. Unknown key ids trigger a
+// refresh of the cached keys. An empty key id matches any key if there is
+// exactly one.
+func (k *keySet) key(kid string) (*rsa.PublicKey, error) {
+	if key, ok := k.cached(kid); ok {
+		return key, nil
+	}
+
+	if err := k.refresh(); err != nil {
+		return nil, err
+	}
+
+	if key, ok := k.cached(kid); ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (k *keySet) cached(kid string) (*rsa.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+// refresh fetches the current keys from UAA, replacing all cached keys.
+func (k *keySet) refresh() error {
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+
+	k.mu.RLock()
+	recent := time.Since(k.lastFetched) < minKeyRefreshInterval
+	k.mu.RUnlock()
+
+	if recent {
+		return nil
+	}
+
+	keys, err := k.fetch()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.lastFetched = time.Now()
+	if err != nil {
+		return err
+	}
+
+	k.keys = keys
+	return nil
+}
+
+// fetch requests and parses the current keys from UAA.
+func (k *keySet) fetch() (map[string]*rsa.PublicKey, error) {
+	resp, err := k.httpClient.Get(k.url)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching token keys: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching token keys: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("error decoding token keys: %v", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing token key %q: %v", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA signing keys found")
+	}
+
+	return keys, nil
+}
+
+// publicKey returns the RSA public key either based on the modulus and
+// exponent or, for older UAA versions, based on the PEM encoded value.
+func (j jsonWebKey) publicKey() (*rsa.PublicKey, error) {
+	if j.N == "" || j.E == "" {
+		return jwt.ParseRSAPublicKeyFromPEM([]byte(j.Value))
+	}
+
+	n, err := decodeBase64URL(j.N)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := decodeBase64URL(j.E)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// UAA does not consistently strip the padding of base64url values
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
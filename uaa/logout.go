@@ -0,0 +1,121 @@
+package uaa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	gctx "github.com/gorilla/context"
+	"github.com/st3v/uaa-proxy/logging"
+
+	"golang.org/x/oauth2"
+)
+
+// Logout returns a handler that deletes the user's session and redirects to
+// UAA's logout endpoint in order to end the user's UAA session as well. The
+// post-logout URL can be requested using the redirect parameter, it must be
+// one of the allowed logout redirects, otherwise the first allowed redirect
+// is used.
+func Logout(uaaURL string, oauth *oauth2.Config, session Session, httpClient *http.Client, opts ...Option) http.Handler {
+	o := newOptions(opts)
+
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	uaaURL = strings.TrimSuffix(uaaURL, "/")
+
+	return gctx.ClearHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// revoke token at UAA
+		if tval, ok := session.Get(r, sessionKeyToken).(oauth2.Token); ok && o.revokeOnLogout {
+			if err := revokeToken(uaaURL, &tval, httpClient); err != nil {
+				// just log it, the session is gone anyway
+				logging.FromRequest(r).Warn("error revoking token", "error", err)
+			}
+		}
+
+		if err := session.Delete(w, r); err != nil {
+			logging.FromRequest(r).Error("error deleting session", "error", err)
+			http.Error(w, "error deleting session", http.StatusInternalServerError)
+			return
+		}
+
+		params := url.Values{
+			"client_id": {oauth.ClientID},
+		}
+
+		if redirect := postLogoutRedirect(r.FormValue("redirect"), o.logoutRedirects); redirect != "" {
+			params.Set("redirect", redirect)
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("%s/logout.do?%s", uaaURL, params.Encode()), http.StatusFound)
+	}))
+}
+
+// postLogoutRedirect returns the requested redirect if it is allowed, the
+// first allowed redirect otherwise.
+func postLogoutRedirect(requested string, allowed []string) string {
+	if len(allowed) == 0 {
+		return ""
+	}
+
+	if contains(allowed, requested) {
+		return requested
+	}
+
+	return allowed[0]
+}
+
+// revokeToken revokes a token using UAA's /oauth/token/revoke/{tokenId}
+// endpoint. The token authenticates its own revocation.
+func revokeToken(uaaURL string, token *oauth2.Token, httpClient *http.Client) error {
+	req, err := http.NewRequest(
+		"DELETE",
+		fmt.Sprintf("%s/oauth/token/revoke/%s", uaaURL, url.PathEscape(tokenID(token.AccessToken))),
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	token.SetAuthHeader(req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// tokenID returns the jti claim of a JWT. Opaque tokens are their own id.
+// The token's signature does not matter here, UAA will reject forged ids.
+func tokenID(raw string) string {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return raw
+	}
+
+	payload, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return raw
+	}
+
+	var claims struct {
+		ID string `json:"jti"`
+	}
+
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ID == "" {
+		return raw
+	}
+
+	return claims.ID
+}
@@ -0,0 +1,34 @@
+package uaa
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/oauth2"
+)
+
+// newNonce returns a random string that binds the id_token to the
+// authorization request it has been issued for.
+func newNonce() (string, error) {
+	return randomURLString(32)
+}
+
+// verifyIDToken verifies the id_token returned alongside the access token and
+// makes sure it has been issued in response to the request with the given nonce.
+func verifyIDToken(token *oauth2.Token, verifier *TokenVerifier, nonce string) (*User, error) {
+	raw, ok := token.Extra("id_token").(string)
+	if !ok || raw == "" {
+		return nil, errors.New("missing id_token")
+	}
+
+	claims, err := verifier.Verify(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if nonce == "" || claims.String("nonce") != nonce {
+		return nil, fmt.Errorf("nonce mismatch, want: %q, have %q", nonce, claims.String("nonce"))
+	}
+
+	return userFromClaims(claims), nil
+}
@@ -0,0 +1,147 @@
+package uaa
+
+import (
+	"html/template"
+)
+
+type options struct {
+	pkceRequired  bool
+	tokenVerifier *TokenVerifier
+	oidcVerifier  *TokenVerifier
+
+	revokeOnLogout  bool
+	logoutRedirects []string
+
+	requiredScopes []string
+	policy         *Policy
+	allowList      *AllowList
+
+	bearerValidator TokenValidator
+	clientCerts     []string
+
+	errorTemplate *template.Template
+
+	redirectHosts   []string
+	defaultRedirect string
+}
+
+// Option configures the behavior of the Authorize and Callback handlers.
+type Option func(o *options)
+
+// WithPKCERequired makes PKCE mandatory. The callback handler will refuse to
+// exchange an authorization code if there is no code verifier in the session.
+func WithPKCERequired(required bool) Option {
+	return func(o *options) {
+		o.pkceRequired = required
+	}
+}
+
+// WithTokenVerifier verifies the signature and claims of every access token
+// obtained during login or refresh. Tokens that fail verification are rejected.
+func WithTokenVerifier(verifier *TokenVerifier) Option {
+	return func(o *options) {
+		o.tokenVerifier = verifier
+	}
+}
+
+// WithOpenIDConnect enables OpenID Connect mode. A nonce is sent along with
+// every authorization request and the id_token returned by UAA is verified
+// using the given verifier. The user's claims are made available to
+// downstream handlers, see UserFromContext.
+func WithOpenIDConnect(verifier *TokenVerifier) Option {
+	return func(o *options) {
+		o.oidcVerifier = verifier
+	}
+}
+
+// WithTokenRevocation makes the Logout handler revoke the user's token at UAA.
+func WithTokenRevocation(revoke bool) Option {
+	return func(o *options) {
+		o.revokeOnLogout = revoke
+	}
+}
+
+// WithLogoutRedirects sets the URLs users can be redirected to by UAA after
+// logging out. The first URL is used by default.
+func WithLogoutRedirects(urls ...string) Option {
+	return func(o *options) {
+		o.logoutRedirects = urls
+	}
+}
+
+// WithRequiredScopes sets the scopes every user must have been granted on
+// every path. By default no scopes are required globally, per-path rules
+// apply in addition.
+func WithRequiredScopes(scopes ...string) Option {
+	return func(o *options) {
+		o.requiredScopes = scopes
+	}
+}
+
+// WithPolicy applies per-path authorization rules to each request.
+func WithPolicy(policy *Policy) Option {
+	return func(o *options) {
+		o.policy = policy
+	}
+}
+
+// WithAllowList restricts access to users on the given allow list.
+func WithAllowList(list *AllowList) Option {
+	return func(o *options) {
+		o.allowList = list
+	}
+}
+
+// WithBearerTokens accepts requests with a bearer token in the Authorization
+// header. Tokens are validated using the given validator, requests are
+// forwarded without creating a session.
+func WithBearerTokens(validator TokenValidator) Option {
+	return func(o *options) {
+		o.bearerValidator = validator
+	}
+}
+
+// WithClientCertificates accepts requests with a verified TLS client
+// certificate whose subject common name or one of its subject alternative
+// names is in the given list. Such requests are forwarded without login, but
+// are subject to required scopes, rules and the allow list like any user.
+// Certificates carry no scopes.
+func WithClientCertificates(allowed ...string) Option {
+	return func(o *options) {
+		o.clientCerts = allowed
+	}
+}
+
+// WithErrorTemplate sets the template used to render OAuth errors returned by
+// UAA, see ErrorPage for the data available to the template.
+func WithErrorTemplate(tmpl *template.Template) Option {
+	return func(o *options) {
+		o.errorTemplate = tmpl
+	}
+}
+
+// WithRedirectHosts allows absolute post-login redirects to the given hosts.
+// By default only same-origin paths are allowed.
+func WithRedirectHosts(hosts ...string) Option {
+	return func(o *options) {
+		o.redirectHosts = hosts
+	}
+}
+
+// WithDefaultRedirect sets the landing page users are redirected to after
+// login if the original request URL is not a valid redirect target.
+func WithDefaultRedirect(url string) Option {
+	return func(o *options) {
+		o.defaultRedirect = url
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		defaultRedirect: "/",
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
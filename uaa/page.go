@@ -0,0 +1,71 @@
+package uaa
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/st3v/uaa-proxy/logging"
+)
+
+var forbiddenPage = template.Must(template.New("forbidden").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Access denied</title></head>
+<body>
+<h1>Access denied</h1>
+<p>You are signed in, but you are not allowed to access this application.</p>
+<dl>
+{{- with .Name}}<dt>User</dt><dd>{{.}}</dd>{{end}}
+{{- with .Email}}<dt>Email</dt><dd>{{.}}</dd>{{end}}
+{{- with .ID}}<dt>User ID</dt><dd>{{.}}</dd>{{end}}
+{{- with .Origin}}<dt>Origin</dt><dd>{{.}}</dd>{{end}}
+</dl>
+</body>
+</html>
+`))
+
+// DefaultErrorTemplate is used to render OAuth errors returned by UAA unless
+// a custom template is configured. Templates are executed with an ErrorPage.
+var DefaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.StatusText}}</title></head>
+<body>
+<h1>{{.StatusText}}</h1>
+<p>Sign in failed: {{if .Description}}{{.Description}}{{else}}{{.Error}}{{end}}</p>
+<p><a href="{{.RetryURL}}">Try again</a></p>
+</body>
+</html>
+`))
+
+// ErrorPage holds the data available to error templates.
+type ErrorPage struct {
+	Status      int
+	StatusText  string
+	Error       string
+	Description string
+	RetryURL    string
+}
+
+// renderError responds with the error page rendered using the given template.
+func renderError(w http.ResponseWriter, tmpl *template.Template, page ErrorPage) {
+	if tmpl == nil {
+		tmpl = DefaultErrorTemplate
+	}
+
+	page.StatusText = http.StatusText(page.Status)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(page.Status)
+	if err := tmpl.Execute(w, page); err != nil {
+		logging.Error("error rendering error page", "error", err)
+	}
+}
+
+// renderForbidden responds with a 403 page stating the identity of the user
+// that has been denied access.
+func renderForbidden(w http.ResponseWriter, user *User) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	if err := forbiddenPage.Execute(w, user); err != nil {
+		logging.Error("error rendering forbidden page", "error", err)
+	}
+}
@@ -0,0 +1,88 @@
+package uaa
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// maximum number of concurrent authorization requests per client, e.g.
+	// for users opening several protected pages in different tabs
+	maxPendingAuths = 10
+
+	// duration after which a pending authorization request is discarded
+	pendingAuthTTL = 10 * time.Minute
+)
+
+// pendingAuth holds everything required to complete an authorization request
+// once UAA redirects back to the callback.
+type pendingAuth struct {
+	Redirect     string
+	CodeVerifier string
+	Nonce        string
+	Expires      time.Time
+}
+
+// pendingRef refers to the session of a pending authorization request.
+type pendingRef struct {
+	Name    string
+	Expires time.Time
+}
+
+// pendingRefs lists the pending authorization requests of a client, oldest
+// first.
+type pendingRefs []pendingRef
+
+// add appends a request, expired requests are pruned. The oldest requests
+// are returned if there are too many.
+func (p pendingRefs) add(ref pendingRef) (pendingRefs, []pendingRef) {
+	p = p.without("")
+
+	evicted := []pendingRef{}
+	for len(p) >= maxPendingAuths {
+		evicted = append(evicted, p[0])
+		p = p[1:]
+	}
+
+	return append(p, ref), evicted
+}
+
+// without returns the unexpired requests except for the given one.
+func (p pendingRefs) without(name string) pendingRefs {
+	now := time.Now()
+	kept := pendingRefs{}
+	for _, ref := range p {
+		if ref.Name != name && now.Before(ref.Expires) {
+			kept = append(kept, ref)
+		}
+	}
+	return kept
+}
+
+// pendingIndexName returns the name of the session listing the pending
+// authorization requests of a client.
+func pendingIndexName(name string) string {
+	return name + "_auth"
+}
+
+// pendingSessionName returns the name of the session keeping the
+// authorization request for a state. Every request gets a session of its own,
+// concurrent logins, e.g. in several tabs, must not overwrite each other.
+func pendingSessionName(name, state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return name + "_auth_" + hex.EncodeToString(sum[:8])
+}
+
+// callbackPath returns the path pending authorization requests are scoped to,
+// their cookies are only sent to the callback.
+func callbackPath(oauth *oauth2.Config) string {
+	u, err := url.Parse(oauth.RedirectURL)
+	if err != nil || u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
@@ -0,0 +1,142 @@
+package uaa
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/st3v/uaa-proxy/uaa/store"
+)
+
+var pendingStores = map[string]func() Session{
+	"cookie": func() Session {
+		return NewSessionStore("uaaproxy", store.NewCookie(time.Hour, []byte("hash-key"), []byte("block-key-16byte")))
+	},
+	"memory": func() Session {
+		return NewSessionStore("uaaproxy", store.NewMemory(time.Hour, 0, []byte("hash-key"), []byte("block-key-16byte")))
+	},
+}
+
+func TestPendingAuthsConcurrentLogins(t *testing.T) {
+	for name, newSession := range pendingStores {
+		t.Run(name, func(t *testing.T) {
+			session := newSession()
+
+			// two tabs start a login on their first visit, without cookies
+			cookies := []*http.Cookie{}
+			for _, state := range []string{"state-a", "state-b"} {
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest("GET", "/page", nil)
+				if err := session.SetPending(rec, req, "/callback", state, pendingAuth{Redirect: "/" + state}); err != nil {
+					t.Fatal(err)
+				}
+				cookies = append(cookies, rec.Result().Cookies()...)
+			}
+
+			for _, c := range cookies {
+				want := "/callback"
+				if c.Name == pendingIndexName("uaaproxy") {
+					want = "/"
+				}
+				if c.Path != want {
+					t.Errorf("cookie %s has path %q, want %s", c.Name, c.Path, want)
+				}
+			}
+
+			// both callbacks find their own request, exactly once
+			for _, state := range []string{"state-b", "state-a"} {
+				req := httptest.NewRequest("GET", "/callback?state="+state, nil)
+				for _, c := range cookies {
+					req.AddCookie(c)
+				}
+
+				rec := httptest.NewRecorder()
+				auth, ok := session.TakePending(rec, req, "/callback", state)
+				if !ok || auth.Redirect != "/"+state {
+					t.Fatalf("state %s: got %+v, %v", state, auth, ok)
+				}
+
+				expired := false
+				for _, c := range rec.Result().Cookies() {
+					expired = expired || c.MaxAge < 0
+				}
+				if !expired {
+					t.Errorf("state %s: pending authorization cookie not expired", state)
+				}
+			}
+
+			req := httptest.NewRequest("GET", "/callback", nil)
+			if _, ok := session.TakePending(httptest.NewRecorder(), req, "/callback", "unknown"); ok {
+				t.Error("unknown state accepted")
+			}
+		})
+	}
+}
+
+func TestPendingAuthsEvictOldest(t *testing.T) {
+	page, _ := url.Parse("https://proxy.example.com/page")
+	callback, _ := url.Parse("https://proxy.example.com/callback")
+
+	for name, newSession := range pendingStores {
+		t.Run(name, func(t *testing.T) {
+			session := newSession()
+			jar, _ := cookiejar.New(nil)
+
+			// one login more than allowed, the browser keeps its cookies
+			for i := 0; i <= maxPendingAuths; i++ {
+				req := httptest.NewRequest("GET", page.String(), nil)
+				for _, c := range jar.Cookies(page) {
+					req.AddCookie(c)
+				}
+
+				rec := httptest.NewRecorder()
+				state := fmt.Sprintf("state-%d", i)
+				if err := session.SetPending(rec, req, "/callback", state, pendingAuth{Redirect: "/" + state}); err != nil {
+					t.Fatal(err)
+				}
+				jar.SetCookies(page, rec.Result().Cookies())
+			}
+
+			pending := 0
+			for _, c := range jar.Cookies(callback) {
+				if strings.HasPrefix(c.Name, "uaaproxy_auth_") {
+					pending++
+				}
+			}
+			if pending != maxPendingAuths {
+				t.Errorf("got %d pending authorization cookies, want %d", pending, maxPendingAuths)
+			}
+
+			take := func(state string) bool {
+				req := httptest.NewRequest("GET", callback.String()+"?state="+state, nil)
+				for _, c := range jar.Cookies(callback) {
+					req.AddCookie(c)
+				}
+
+				rec := httptest.NewRecorder()
+				_, ok := session.TakePending(rec, req, "/callback", state)
+				jar.SetCookies(callback, rec.Result().Cookies())
+				return ok
+			}
+
+			if take("state-0") {
+				t.Error("oldest pending authorization not evicted")
+			}
+
+			for i := 1; i <= maxPendingAuths; i++ {
+				if !take(fmt.Sprintf("state-%d", i)) {
+					t.Errorf("state-%d: pending authorization not found", i)
+				}
+			}
+
+			if cookies := jar.Cookies(callback); len(cookies) != 0 {
+				t.Errorf("cookies left after all logins completed: %v", cookies)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package uaa
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+
+	"golang.org/x/oauth2"
+)
+
+// code challenge method as defined in RFC 7636, UAA does not need to support
+// the weaker plain method
+const codeChallengeMethod = "S256"
+
+// newCodeVerifier returns a high-entropy cryptographic random string that is
+// used as PKCE code verifier. The returned string is 43 characters long and
+// only contains unreserved URL characters.
+func newCodeVerifier() (string, error) {
+	return randomURLString(32)
+}
+
+// randomURLString returns the base64url encoding of n cryptographic random
+// bytes.
+func randomURLString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// codeChallenge derives the S256 code challenge for a given code verifier.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// codeChallengeOptions returns the auth code options required to send the
+// code challenge for a given verifier to the authorization endpoint.
+func codeChallengeOptions(verifier string) []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", codeChallengeMethod),
+	}
+}
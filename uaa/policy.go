@@ -0,0 +1,167 @@
+package uaa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Rule describes the authorization requirements for requests matching a path
+// pattern and, optionally, a set of HTTP methods. Patterns are matched
+// segment by segment, * matches a single segment, ** matches any number of
+// segments.
+type Rule struct {
+	Path      string   `json:"path"`
+	Methods   []string `json:"methods,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+	Match     string   `json:"match,omitempty"`
+	Anonymous bool     `json:"anonymous,omitempty"`
+}
+
+// rule scope matching semantics
+const (
+	MatchAll = "all"
+	MatchAny = "any"
+)
+
+// Policy is an ordered list of rules, the first matching rule applies.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadPolicy reads a JSON encoded policy from a file.
+func LoadPolicy(file string) (*Policy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	policy := new(Policy)
+	if err := json.NewDecoder(f).Decode(policy); err != nil {
+		return nil, fmt.Errorf("error decoding policy: %v", err)
+	}
+
+	return policy, policy.Validate()
+}
+
+// Validate checks all rules of the policy.
+func (p *Policy) Validate() error {
+	for i, rule := range p.Rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("rule %d: path %q must start with /", i, rule.Path)
+		}
+
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return fmt.Errorf("rule %d: invalid path %q: %v", i, rule.Path, err)
+		}
+
+		if rule.Match != "" && rule.Match != MatchAll && rule.Match != MatchAny {
+			return fmt.Errorf("rule %d: match must be either %q or %q", i, MatchAll, MatchAny)
+		}
+	}
+
+	return nil
+}
+
+// Scopes returns all scopes referenced by the policy.
+func (p *Policy) Scopes() []string {
+	scopes := []string{}
+	for _, rule := range p.Rules {
+		for _, scope := range rule.Scopes {
+			if !contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
+
+// rule returns the first rule matching the request.
+func (p *Policy) rule(r *http.Request) (*Rule, bool) {
+	if p == nil {
+		return nil, false
+	}
+
+	for i, rule := range p.Rules {
+		if rule.matches(r) {
+			return &p.Rules[i], true
+		}
+	}
+
+	return nil, false
+}
+
+func (r Rule) matches(req *http.Request) bool {
+	if len(r.Methods) > 0 {
+		ok := false
+		for _, m := range r.Methods {
+			if strings.EqualFold(m, req.Method) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return matchPath(r.Path, path.Clean("/"+req.URL.Path))
+}
+
+// allows checks the given scopes against the scopes required by the rule.
+func (r Rule) allows(scopes []string) bool {
+	if r.Match != MatchAny {
+		return hasRequiredScopes(scopes, r.Scopes)
+	}
+
+	for _, scope := range r.Scopes {
+		if contains(scopes, scope) {
+			return true
+		}
+	}
+
+	return len(r.Scopes) == 0
+}
+
+// matchPath matches a path against a pattern segment by segment.
+func matchPath(pattern, p string) bool {
+	return matchSegments(splitPath(pattern), splitPath(p))
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// try to match the remaining pattern at every position
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+
+		pattern, segments = pattern[1:], segments[1:]
+	}
+
+	return len(segments) == 0
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
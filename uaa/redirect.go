@@ -0,0 +1,72 @@
+package uaa
+
+import (
+	"net/url"
+	"strings"
+)
+
+// safeRedirect returns the target if it is a same-origin path or an absolute
+// http(s) URL pointing to one of the allowed hosts, the fallback otherwise.
+// Browsers are lenient when parsing Location headers, targets containing
+// backslashes or control characters, or resolving to a scheme-relative URL
+// after unescaping, are rejected.
+func safeRedirect(target string, allowedHosts []string, fallback string) string {
+	if target == "" || strings.ContainsAny(target, "\\") {
+		return fallback
+	}
+
+	for _, c := range target {
+		if c < 0x20 || c == 0x7f || c == ' ' {
+			return fallback
+		}
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return fallback
+	}
+
+	if u.Scheme != "" || u.Host != "" || u.User != nil {
+		if (u.Scheme == "http" || u.Scheme == "https") && u.User == nil && containsFold(allowedHosts, u.Host) {
+			return target
+		}
+		return fallback
+	}
+
+	if !strings.HasPrefix(target, "/") || isSchemeRelative(target) {
+		return fallback
+	}
+
+	// encoded variants like /%2F%2Fevil.com or /%5Cevil.com
+	unescaped := target
+	for i := 0; i < 3; i++ {
+		s, err := url.PathUnescape(unescaped)
+		if err != nil {
+			return fallback
+		}
+
+		if s == unescaped {
+			break
+		}
+
+		if strings.Contains(s, "\\") || isSchemeRelative(s) {
+			return fallback
+		}
+		unescaped = s
+	}
+
+	return target
+}
+
+func isSchemeRelative(s string) bool {
+	return strings.HasPrefix(s, "//")
+}
+
+func containsFold(haystack []string, needle string) bool {
+	for _, h := range haystack {
+		if strings.EqualFold(h, needle) {
+			return true
+		}
+	}
+	return false
+}
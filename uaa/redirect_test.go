@@ -0,0 +1,65 @@
+package uaa
+
+import "testing"
+
+func TestSafeRedirect(t *testing.T) {
+	allowed := []string{"app.example.com", "Other.Example.com:8443"}
+	const fallback = "/"
+
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"empty", "", fallback},
+		{"path", "/foo/bar", "/foo/bar"},
+		{"path with query", "/foo?a=b&c=%2F", "/foo?a=b&c=%2F"},
+		{"path with fragment", "/foo#section", "/foo#section"},
+		{"root", "/", "/"},
+		{"encoded single slash", "/foo%2Fbar", "/foo%2Fbar"},
+
+		{"scheme relative", "//evil.com", fallback},
+		{"scheme relative with path", "//evil.com/foo", fallback},
+		{"triple slash", "///evil.com", fallback},
+		{"backslash", "\\evil.com", fallback},
+		{"double backslash", "\\\\evil.com", fallback},
+		{"slash backslash", "/\\evil.com", fallback},
+		{"backslash slash", "\\/evil.com", fallback},
+		{"encoded scheme relative", "%2F%2Fevil.com", fallback},
+		{"slash encoded slash", "/%2Fevil.com", fallback},
+		{"slash encoded slashes", "/%2F%2Fevil.com", fallback},
+		{"lowercase encoded slash", "/%2fevil.com", fallback},
+		{"encoded backslash", "/%5Cevil.com", fallback},
+		{"double encoded slash", "/%252Fevil.com", fallback},
+		{"double encoded backslash", "/%255Cevil.com", fallback},
+		{"invalid escape", "/%zz", fallback},
+		{"tab", "/\t/evil.com", fallback},
+		{"newline", "/foo\nLocation: //evil.com", fallback},
+		{"leading space", " //evil.com", fallback},
+		{"relative path", "foo/bar", fallback},
+
+		{"allowed host", "https://app.example.com/foo", "https://app.example.com/foo"},
+		{"allowed host http", "http://app.example.com/", "http://app.example.com/"},
+		{"allowed host case insensitive", "https://APP.example.com/foo", "https://APP.example.com/foo"},
+		{"allowed host with port", "https://other.example.com:8443/x", "https://other.example.com:8443/x"},
+		{"allowed host wrong port", "https://other.example.com/x", fallback},
+		{"disallowed host", "https://evil.com/foo", fallback},
+		{"allowed host as subdomain", "https://app.example.com.evil.com/", fallback},
+		{"allowed host with userinfo", "https://user@app.example.com/", fallback},
+		{"userinfo tricking host", "https://app.example.com@evil.com/", fallback},
+		{"allowed host other scheme", "ftp://app.example.com/", fallback},
+
+		{"javascript", "javascript:alert(1)", fallback},
+		{"javascript uppercase", "JavaScript:alert(1)", fallback},
+		{"javascript with slashes", "javascript://app.example.com/%0aalert(1)", fallback},
+		{"data", "data:text/html,<script>alert(1)</script>", fallback},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := safeRedirect(tt.target, allowed, fallback); got != tt.want {
+				t.Errorf("safeRedirect(%q) = %q, want %q", tt.target, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,17 +1,28 @@
 package register
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"code.cloudfoundry.org/clock"
-	"code.cloudfoundry.org/lager"
 	uaago "code.cloudfoundry.org/uaa-go-client"
 	"code.cloudfoundry.org/uaa-go-client/config"
 	"code.cloudfoundry.org/uaa-go-client/schema"
 )
 
 type registrar struct {
-	uaac uaago.Client
+	uaac   uaago.Client
+	uaaURL string
+	client *http.Client
 }
 
 func Registrar(uaaURL, clientID, clientSecret string, caCertPath string, tlsSkipVerify bool) (*registrar, error) {
@@ -26,31 +37,227 @@ func Registrar(uaaURL, clientID, clientSecret string, caCertPath string, tlsSkip
 		ExpirationBufferInSec: config.DefaultExpirationBufferInSec,
 	}
 
-	uaac, err := uaago.NewClient(new(noopLogger), config, clock.NewClock())
-	return &registrar{uaac}, err
+	uaac, err := uaago.NewClient(new(lagerLogger), config, clock.NewClock())
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := httpClient(caCertPath, tlsSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registrar{uaac, strings.TrimSuffix(uaaURL, "/"), client}, nil
 }
 
-func (r *registrar) RegisterClient(id, secret string, opts ...option) error {
-	client := &schema.OauthClient{
+// RegisterClient creates the client or updates an existing client whose
+// settings or secret differ. The result reports what has been changed.
+func (r *registrar) RegisterClient(id, secret string, opts ...option) (*Result, error) {
+	desired := &schema.OauthClient{
 		ClientId:     id,
 		ClientSecret: secret,
 	}
 
 	for _, opt := range opts {
-		opt(client)
+		opt(desired)
+	}
+
+	token, err := r.uaac.FetchToken(false)
+	if err != nil {
+		return nil, err
+	}
+	auth := "bearer " + token.AccessToken
+
+	existing, raw, err := r.get(id, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing == nil {
+		if err := r.do("POST", "/oauth/clients", auth, desired, http.StatusCreated); err != nil {
+			return nil, fmt.Errorf("error creating client: %v", err)
+		}
+		return &Result{Created: true}, nil
+	}
+
+	result := &Result{Changes: diff(existing, desired)}
+
+	if len(result.Changes) > 0 {
+		// keep fields that are not managed by the proxy
+		for k, v := range managedFields(desired) {
+			raw[k] = v
+		}
+
+		if err := r.do("PUT", "/oauth/clients/"+url.PathEscape(id), auth, raw, http.StatusOK); err != nil {
+			return nil, fmt.Errorf("error updating client: %v", err)
+		}
+	}
+
+	valid, err := r.secretValid(id, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if !valid {
+		change := map[string]string{"clientId": id, "secret": secret}
+		if err := r.do("PUT", "/oauth/clients/"+url.PathEscape(id)+"/secret", auth, change, http.StatusOK); err != nil {
+			return nil, fmt.Errorf("error changing client secret: %v", err)
+		}
+		result.SecretChanged = true
+	}
+
+	return result, nil
+}
+
+// get returns the registered client, or nil if there is none, along with its
+// complete JSON representation.
+func (r *registrar) get(id, auth string) (*schema.OauthClient, map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", r.uaaURL+"/oauth/clients/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", auth)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("error fetching client: %s", statusError(resp, body))
+	}
+
+	client := new(schema.OauthClient)
+	if err := json.Unmarshal(body, client); err != nil {
+		return nil, nil, fmt.Errorf("error decoding client: %v", err)
+	}
+
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, nil, fmt.Errorf("error decoding client: %v", err)
+	}
+
+	return client, raw, nil
+}
+
+// do sends v as JSON and expects the given status.
+func (r *registrar) do(method, path, auth string, v interface{}, status int) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, r.uaaURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", auth)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return statusError(resp, body)
 	}
 
-	_, err := r.uaac.RegisterOauthClient(client)
-	return err
+	return nil
 }
 
-type noopLogger struct{}
+// secretValid checks whether UAA accepts the secret of the client. The
+// client is usually not allowed to use the client_credentials grant, UAA then
+// refuses the grant with unauthorized_client after authenticating the client.
+// Only invalid_client and bad credentials errors mean the secret is wrong.
+func (r *registrar) secretValid(id, secret string) (bool, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
 
-func (n *noopLogger) RegisterSink(lager.Sink)                    {}
-func (n *noopLogger) Session(string, ...lager.Data) lager.Logger { return n }
-func (n *noopLogger) SessionName() string                        { return "noop" }
-func (n *noopLogger) Debug(string, ...lager.Data)                {}
-func (n *noopLogger) Info(string, ...lager.Data)                 {}
-func (n *noopLogger) Error(string, error, ...lager.Data)         {}
-func (n *noopLogger) Fatal(string, error, ...lager.Data)         {}
-func (n *noopLogger) WithData(lager.Data) lager.Logger           { return n }
+	req, err := http.NewRequest("POST", r.uaaURL+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(id), url.QueryEscape(secret))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("error checking client secret: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return true, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return false, fmt.Errorf("error checking client secret: %v", err)
+	}
+
+	var oauthErr struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+
+	if resp.StatusCode >= 500 || json.Unmarshal(body, &oauthErr) != nil || oauthErr.Error == "" {
+		return false, fmt.Errorf("error checking client secret: %s", statusError(resp, body))
+	}
+
+	switch {
+	case oauthErr.Error == "invalid_client", strings.EqualFold(oauthErr.Description, "Bad credentials"):
+		return false, nil
+	default:
+		return true, nil
+	}
+}
+
+// managedFields returns the JSON fields of the client set by the proxy.
+func managedFields(c *schema.OauthClient) map[string]interface{} {
+	return map[string]interface{}{
+		"name":                   c.Name,
+		"scope":                  c.Scope,
+		"authorities":            c.Authorities,
+		"authorized_grant_types": c.AuthorizedGrantTypes,
+		"access_token_validity":  c.AccessTokenValidity,
+		"redirect_uri":           c.RedirectUri,
+	}
+}
+
+func httpClient(caCertPath string, skipVerify bool) (*http.Client, error) {
+	config := &tls.Config{InsecureSkipVerify: skipVerify}
+
+	if caCertPath != "" {
+		cert, err := ioutil.ReadFile(caCertPath)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AppendCertsFromPEM(cert)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+func statusError(resp *http.Response, body []byte) error {
+	return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(body))
+}
@@ -0,0 +1,121 @@
+package register
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/uaa-go-client/schema"
+)
+
+// Result reports what registering a client has changed.
+type Result struct {
+	Created       bool
+	Changes       []Change
+	SecretChanged bool
+}
+
+// Changed returns whether the client has been created or modified.
+func (r *Result) Changed() bool {
+	return r.Created || r.SecretChanged || len(r.Changes) > 0
+}
+
+// Change is a field of the client that has been updated. List fields report
+// added and removed values, other fields their old and new value.
+type Change struct {
+	Field   string
+	Old     string
+	New     string
+	Added   []string
+	Removed []string
+}
+
+func (c Change) String() string {
+	if c.Added == nil && c.Removed == nil {
+		return fmt.Sprintf("%s: %q -> %q", c.Field, c.Old, c.New)
+	}
+
+	parts := []string{}
+	for _, v := range c.Added {
+		parts = append(parts, "+"+v)
+	}
+	for _, v := range c.Removed {
+		parts = append(parts, "-"+v)
+	}
+	return fmt.Sprintf("%s: %s", c.Field, strings.Join(parts, " "))
+}
+
+// diff returns the changes needed to turn the existing into the desired
+// client. Lists are compared as sets.
+func diff(existing, desired *schema.OauthClient) []Change {
+	changes := []Change{}
+
+	if existing.Name != desired.Name {
+		changes = append(changes, Change{Field: "name", Old: existing.Name, New: desired.Name})
+	}
+
+	lists := []struct {
+		field             string
+		existing, desired []string
+	}{
+		{"scope", withoutNone(existing.Scope), desired.Scope},
+		{"authorized_grant_types", existing.AuthorizedGrantTypes, desired.AuthorizedGrantTypes},
+		{"redirect_uri", existing.RedirectUri, desired.RedirectUri},
+		{"authorities", withoutNone(existing.Authorities), desired.Authorities},
+	}
+
+	for _, l := range lists {
+		added, removed := diffSets(l.existing, l.desired)
+		if len(added)+len(removed) > 0 {
+			changes = append(changes, Change{Field: l.field, Added: added, Removed: removed})
+		}
+	}
+
+	if existing.AccessTokenValidity != desired.AccessTokenValidity {
+		changes = append(changes, Change{
+			Field: "access_token_validity",
+			Old:   strconv.Itoa(existing.AccessTokenValidity),
+			New:   strconv.Itoa(desired.AccessTokenValidity),
+		})
+	}
+
+	return changes
+}
+
+// diffSets returns the sorted values only in desired and only in existing.
+func diffSets(existing, desired []string) (added, removed []string) {
+	in := func(values []string, v string) bool {
+		for _, w := range values {
+			if w == v {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, v := range desired {
+		if !in(existing, v) && !in(added, v) {
+			added = append(added, v)
+		}
+	}
+
+	for _, v := range existing {
+		if !in(desired, v) && !in(removed, v) {
+			removed = append(removed, v)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// withoutNone drops the placeholder UAA stores for empty scopes and
+// authorities.
+func withoutNone(values []string) []string {
+	if len(values) == 1 && values[0] == "uaa.none" {
+		return nil
+	}
+	return values
+}
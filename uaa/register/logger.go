@@ -0,0 +1,87 @@
+package register
+
+import (
+	"sort"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/st3v/uaa-proxy/logging"
+)
+
+// lagerLogger forwards the logs of the UAA client to the proxy's logger.
+type lagerLogger struct {
+	session string
+	data    lager.Data
+}
+
+func (l *lagerLogger) RegisterSink(lager.Sink) {}
+
+func (l *lagerLogger) Session(task string, data ...lager.Data) lager.Logger {
+	session := task
+	if l.session != "" {
+		session = l.session + "." + task
+	}
+	return &lagerLogger{session, merge(append([]lager.Data{l.data}, data...))}
+}
+
+func (l *lagerLogger) SessionName() string {
+	return l.session
+}
+
+func (l *lagerLogger) Debug(action string, data ...lager.Data) {
+	logging.Debug(action, l.fields(nil, data)...)
+}
+
+func (l *lagerLogger) Info(action string, data ...lager.Data) {
+	logging.Info(action, l.fields(nil, data)...)
+}
+
+func (l *lagerLogger) Error(action string, err error, data ...lager.Data) {
+	logging.Error(action, l.fields(err, data)...)
+}
+
+// Fatal panics the same way lager does.
+func (l *lagerLogger) Fatal(action string, err error, data ...lager.Data) {
+	logging.Error(action, l.fields(err, data)...)
+	panic(err)
+}
+
+func (l *lagerLogger) WithData(data lager.Data) lager.Logger {
+	return &lagerLogger{l.session, merge([]lager.Data{l.data, data})}
+}
+
+// fields returns the session, error and data as key-value pairs ordered by
+// key.
+func (l *lagerLogger) fields(err error, data []lager.Data) []interface{} {
+	fields := []interface{}{"component", "uaa-client"}
+
+	if l.session != "" {
+		fields = append(fields, "session", l.session)
+	}
+
+	if err != nil {
+		fields = append(fields, "error", err)
+	}
+
+	all := merge(append([]lager.Data{l.data}, data...))
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fields = append(fields, k, all[k])
+	}
+
+	return fields
+}
+
+func merge(data []lager.Data) lager.Data {
+	merged := lager.Data{}
+	for _, d := range data {
+		for k, v := range d {
+			merged[k] = v
+		}
+	}
+	return merged
+}
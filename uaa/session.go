@@ -3,19 +3,19 @@ package uaa
 import (
 	"encoding/gob"
 	"net/http"
-	"os"
+	"time"
 
-	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
+	"github.com/st3v/uaa-proxy/logging"
 
 	"golang.org/x/oauth2"
 )
 
 const (
 	// keys used for session values
-	sessionKeyToken    = "token"
-	sessionKeyRedirect = "redirect"
-	sessionKeyState    = "state"
+	sessionKeyToken   = "token"
+	sessionKeyPending = "pending"
+	sessionKeyUser    = "user"
 )
 
 type session struct {
@@ -25,23 +25,20 @@ type session struct {
 
 func init() {
 	gob.Register(oauth2.Token{})
+	gob.Register(User{})
+	gob.Register(pendingAuth{})
+	gob.Register(pendingRefs{})
 }
 
 type Session interface {
 	Get(r *http.Request, key string) interface{}
 	Set(w http.ResponseWriter, r *http.Request, key string, value interface{}) error
+	Delete(w http.ResponseWriter, r *http.Request) error
+	SetPending(w http.ResponseWriter, r *http.Request, path, state string, auth pendingAuth) error
+	TakePending(w http.ResponseWriter, r *http.Request, path, state string) (pendingAuth, bool)
 }
 
-func NewSessionStore(name string, hashKey, blockKey []byte) *session {
-	if len(hashKey) == 0 {
-		hashKey = securecookie.GenerateRandomKey(64)
-	}
-
-	blockKey = adjustBlockKey(blockKey)
-
-	store := sessions.NewFilesystemStore(os.TempDir(), hashKey, blockKey)
-	store.MaxLength(8096)
-
+func NewSessionStore(name string, store sessions.Store) *session {
 	return &session{
 		name:  name,
 		store: store,
@@ -64,23 +61,108 @@ func (s *session) Set(w http.ResponseWriter, r *http.Request, key string, value
 	return s.store.Save(r, w, sess)
 }
 
-// blockKey must either be 32-, 24-, or 16-byte long
-func adjustBlockKey(key []byte) []byte {
-	if len(key) > 32 {
-		key = key[:32]
+// Delete removes all values from the session and expires the session cookie.
+// Server-side session data is removed as well.
+func (s *session) Delete(w http.ResponseWriter, r *http.Request) error {
+	// store.Get will always return a session, in the error case it will be empty
+	sess, _ := s.store.Get(r, s.name)
+	if sess.IsNew {
+		// nothing to delete
+		return nil
+	}
+
+	for key := range sess.Values {
+		delete(sess.Values, key)
+	}
+	sess.Options.MaxAge = -1
+	return s.store.Save(r, w, sess)
+}
+
+// SetPending stores an authorization request in a session of its own. The
+// session cookie is restricted to the given path. The oldest requests of the
+// client are discarded if it has too many pending.
+func (s *session) SetPending(w http.ResponseWriter, r *http.Request, path, state string, auth pendingAuth) error {
+	// store.New will always return a session, in the error case it will be empty
+	sess, _ := s.store.New(r, pendingSessionName(s.name, state))
+
+	auth.Expires = time.Now().Add(pendingAuthTTL)
+	sess.Values[sessionKeyPending] = auth
+	sess.Options.Path = path
+	sess.Options.MaxAge = int(pendingAuthTTL.Seconds())
+
+	if err := s.store.Save(r, w, sess); err != nil {
+		return err
+	}
+
+	index, _ := s.store.New(r, pendingIndexName(s.name))
+	refs, _ := index.Values[sessionKeyPending].(pendingRefs)
+
+	refs, evicted := refs.add(pendingRef{sess.Name(), auth.Expires})
+	for _, ref := range evicted {
+		s.expire(w, r, ref.Name, path)
+	}
+
+	index.Values[sessionKeyPending] = refs
+	index.Options.Path = "/"
+	index.Options.MaxAge = int(pendingAuthTTL.Seconds())
+
+	return s.store.Save(r, w, index)
+}
+
+// TakePending returns the authorization request for a state and deletes its
+// session.
+func (s *session) TakePending(w http.ResponseWriter, r *http.Request, path, state string) (pendingAuth, bool) {
+	if state == "" {
+		return pendingAuth{}, false
 	}
 
-	if l := len(key); l < 32 && l > 24 {
-		key = key[:24]
+	sess, err := s.store.New(r, pendingSessionName(s.name, state))
+	if sess.IsNew {
+		return pendingAuth{}, false
 	}
 
-	if l := len(key); l < 32 && l > 16 {
-		key = key[:16]
+	auth, ok := sess.Values[sessionKeyPending].(pendingAuth)
+
+	// the request is completed either way
+	s.expire(w, r, sess.Name(), path)
+
+	index, _ := s.store.New(r, pendingIndexName(s.name))
+	if refs, ok := index.Values[sessionKeyPending].(pendingRefs); ok {
+		refs = refs.without(sess.Name())
+		index.Values[sessionKeyPending] = refs
+		index.Options.Path = "/"
+		index.Options.MaxAge = int(pendingAuthTTL.Seconds())
+		if len(refs) == 0 {
+			index.Options.MaxAge = -1
+		}
+
+		if err := s.store.Save(r, w, index); err != nil {
+			logging.FromRequest(r).Error("error updating pending authorizations", "error", err)
+		}
 	}
 
-	if len(key) < 16 {
-		key = securecookie.GenerateRandomKey(32)
+	if err != nil || !ok || time.Now().After(auth.Expires) {
+		return pendingAuth{}, false
 	}
 
-	return key
+	return auth, true
+}
+
+// expire deletes the session with the given name and cookie path.
+func (s *session) expire(w http.ResponseWriter, r *http.Request, name, path string) {
+	// store.New will always return a session, in the error case it will be empty
+	sess, _ := s.store.New(r, name)
+	sess.Options.Path = path
+	sess.Options.MaxAge = -1
+
+	// the cookie is not sent outside of its path, server-side data then
+	// expires on its own
+	if sess.IsNew {
+		http.SetCookie(w, sessions.NewCookie(name, "", sess.Options))
+		return
+	}
+
+	if err := s.store.Save(r, w, sess); err != nil {
+		logging.FromRequest(r).Error("error deleting pending authorization", "error", err)
+	}
 }
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// maximum length of a single cookie value, leaves room for the cookie's
+	// name and attributes within the 4096 bytes supported by browsers
+	cookieChunkSize = 3800
+
+	// upper limit for the number of chunks, protects against huge requests
+	maxCookieChunks = 10
+)
+
+// cookieStore keeps sessions entirely in cookies. Encoded sessions that
+// exceed the size of a single cookie, which is common for UAA tokens, are
+// split into multiple cookies.
+type cookieStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+// NewCookie returns a store that keeps sessions in chunked cookies.
+func NewCookie(maxAge time.Duration, keyPairs ...[]byte) sessions.Store {
+	return &cookieStore{
+		Codecs: codecs(maxAge, keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: int(maxAge.Seconds()),
+		},
+	}
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (s *cookieStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+func (s *cookieStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	chunks := []string{}
+	for i := 0; i < maxCookieChunks; i++ {
+		c, err := r.Cookie(chunkName(name, i))
+		if err != nil {
+			break
+		}
+		chunks = append(chunks, c.Value)
+	}
+
+	if len(chunks) == 0 {
+		return session, nil
+	}
+
+	if err := securecookie.DecodeMulti(name, strings.Join(chunks, ""), &session.Values, s.Codecs...); err != nil {
+		return session, err
+	}
+
+	session.IsNew = false
+	return session, nil
+}
+
+// Save encodes the session and writes it to as many cookies as needed. Chunks
+// left over from a previously larger session are expired.
+func (s *cookieStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	chunks := []string{}
+
+	if session.Options.MaxAge > 0 {
+		encoded, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+		if err != nil {
+			return err
+		}
+
+		chunks = splitChunks(encoded, cookieChunkSize)
+
+		if len(chunks) > maxCookieChunks {
+			return fmt.Errorf("session too large: %d cookies required", len(chunks))
+		}
+	}
+
+	for i, chunk := range chunks {
+		http.SetCookie(w, sessions.NewCookie(chunkName(session.Name(), i), chunk, session.Options))
+	}
+
+	expired := *session.Options
+	expired.MaxAge = -1
+	for i := len(chunks); i < maxCookieChunks; i++ {
+		name := chunkName(session.Name(), i)
+		if _, err := r.Cookie(name); err == nil || cookieWritten(w, name) {
+			http.SetCookie(w, sessions.NewCookie(name, "", &expired))
+		}
+	}
+
+	return nil
+}
+
+// splitChunks splits an encoded session into values of at most size bytes.
+func splitChunks(encoded string, size int) []string {
+	chunks := []string{}
+	for len(encoded) > size {
+		chunks = append(chunks, encoded[:size])
+		encoded = encoded[size:]
+	}
+	return append(chunks, encoded)
+}
+
+// cookieWritten checks if a cookie has already been set on the response, the
+// session might be saved multiple times during a single request.
+func cookieWritten(w http.ResponseWriter, name string) bool {
+	for _, c := range w.Header()["Set-Cookie"] {
+		if strings.HasPrefix(c, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// the first chunk uses the plain session name
+func chunkName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s_%d", name, i)
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestSplitChunks(t *testing.T) {
+	tests := []struct {
+		length int
+		want   []int
+	}{
+		{0, []int{0}},
+		{1, []int{1}},
+		{cookieChunkSize - 1, []int{cookieChunkSize - 1}},
+		{cookieChunkSize, []int{cookieChunkSize}},
+		{cookieChunkSize + 1, []int{cookieChunkSize, 1}},
+		{2 * cookieChunkSize, []int{cookieChunkSize, cookieChunkSize}},
+		{2*cookieChunkSize + 7, []int{cookieChunkSize, cookieChunkSize, 7}},
+	}
+
+	for _, tt := range tests {
+		encoded := strings.Repeat("x", tt.length)
+		chunks := splitChunks(encoded, cookieChunkSize)
+
+		if len(chunks) != len(tt.want) {
+			t.Errorf("length %d: got %d chunks, want %d", tt.length, len(chunks), len(tt.want))
+			continue
+		}
+
+		for i, chunk := range chunks {
+			if len(chunk) != tt.want[i] {
+				t.Errorf("length %d: chunk %d has %d bytes, want %d", tt.length, i, len(chunk), tt.want[i])
+			}
+		}
+
+		if strings.Join(chunks, "") != encoded {
+			t.Errorf("length %d: chunks do not reassemble", tt.length)
+		}
+	}
+}
+
+func newTestCookieStore() sessions.Store {
+	return NewCookie(time.Hour, []byte("hash-key"), []byte("block-key-16byte"))
+}
+
+// saveSession saves a session with a token of the given size and returns the
+// response cookies.
+func saveSession(t *testing.T, store sessions.Store, req *http.Request, tokenSize int) []*http.Cookie {
+	t.Helper()
+
+	session, err := store.New(req, "uaaproxy")
+	if err != nil && tokenSize > 0 {
+		t.Fatal(err)
+	}
+	session.Values["token"] = strings.Repeat("t", tokenSize)
+
+	rec := httptest.NewRecorder()
+	if err := session.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result().Cookies()
+}
+
+func TestCookieStoreChunks(t *testing.T) {
+	store := newTestCookieStore()
+
+	for _, size := range []int{10, cookieChunkSize, 3 * cookieChunkSize} {
+		cookies := saveSession(t, store, httptest.NewRequest("GET", "/", nil), size)
+
+		for _, c := range cookies {
+			if len(c.Value) > cookieChunkSize {
+				t.Errorf("size %d: cookie %s has %d bytes", size, c.Name, len(c.Value))
+			}
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+
+		session, err := store.New(req, "uaaproxy")
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if session.IsNew || session.Values["token"] != strings.Repeat("t", size) {
+			t.Errorf("size %d: session not reassembled from %d cookies", size, len(cookies))
+		}
+	}
+}
+
+func TestCookieStoreExpiresLeftoverChunks(t *testing.T) {
+	store := newTestCookieStore()
+
+	large := saveSession(t, store, httptest.NewRequest("GET", "/", nil), 3*cookieChunkSize)
+	if len(large) < 3 {
+		t.Fatalf("got %d cookies, want at least 3", len(large))
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range large {
+		req.AddCookie(c)
+	}
+
+	small := saveSession(t, store, req, 10)
+
+	written, expired := 0, 0
+	for _, c := range small {
+		if c.MaxAge < 0 {
+			expired++
+		} else {
+			written++
+		}
+	}
+
+	if written != 1 || expired != len(large)-1 {
+		t.Errorf("got %d written and %d expired cookies, want 1 and %d", written, expired, len(large)-1)
+	}
+}
+
+func TestCookieStoreTooLarge(t *testing.T) {
+	store := newTestCookieStore()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	session, _ := store.New(req, "uaaproxy")
+	session.Values["token"] = strings.Repeat("t", (maxCookieChunks+1)*cookieChunkSize)
+
+	if err := session.Save(req, httptest.NewRecorder()); err == nil {
+		t.Fatal("expected error for session exceeding the maximum number of chunks")
+	}
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/st3v/uaa-proxy/logging"
+)
+
+// NewFilesystem returns a store that keeps sessions in files in the given
+// directory. Session files that have not been modified for longer than maxAge
+// are removed every gcInterval.
+func NewFilesystem(dir string, maxAge, gcInterval time.Duration, keyPairs ...[]byte) sessions.Store {
+	store := sessions.NewFilesystemStore(dir, keyPairs...)
+	store.MaxAge(int(maxAge.Seconds()))
+	store.MaxLength(8096)
+
+	if gcInterval > 0 {
+		go func() {
+			for range time.Tick(gcInterval) {
+				if err := removeExpiredFiles(dir, maxAge); err != nil {
+					logging.Error("error removing expired session files", "dir", dir, "error", err)
+				}
+			}
+		}()
+	}
+
+	return store
+}
+
+// removeExpiredFiles deletes the session files in dir that have not been
+// modified for longer than maxAge.
+func removeExpiredFiles(dir string, maxAge time.Duration) error {
+	files, err := filepath.Glob(filepath.Join(dir, "session_*"))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil || info.IsDir() || !strings.HasPrefix(info.Name(), "session_") {
+			continue
+		}
+
+		if time.Since(info.ModTime()) > maxAge {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+type memoryEntry struct {
+	data    string
+	expires time.Time
+}
+
+// memory is a backend that keeps sessions in memory, sessions are lost when
+// the process exits.
+type memory struct {
+	mu      sync.RWMutex
+	entries map[string]memoryEntry
+}
+
+// NewMemory returns a store that keeps sessions in memory. Expired sessions
+// are evicted every cleanupInterval.
+func NewMemory(maxAge, cleanupInterval time.Duration, keyPairs ...[]byte) sessions.Store {
+	m := &memory{
+		entries: map[string]memoryEntry{},
+	}
+
+	if cleanupInterval > 0 {
+		go func() {
+			for range time.Tick(cleanupInterval) {
+				m.evict()
+			}
+		}()
+	}
+
+	return newServerStore(m, maxAge, keyPairs...)
+}
+
+func (m *memory) load(id string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, ok := m.entries[id]
+	if !ok || time.Now().After(e.expires) {
+		return "", errNotFound
+	}
+
+	return e.data, nil
+}
+
+func (m *memory) save(id, data string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[id] = memoryEntry{
+		data:    data,
+		expires: time.Now().Add(ttl),
+	}
+
+	return nil
+}
+
+func (m *memory) erase(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, id)
+	return nil
+}
+
+// evict removes all expired sessions
+func (m *memory) evict() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id, e := range m.entries {
+		if now.After(e.expires) {
+			delete(m.entries, id)
+		}
+	}
+}
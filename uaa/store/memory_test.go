@@ -0,0 +1,38 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryExpiry(t *testing.T) {
+	m := &memory{entries: map[string]memoryEntry{}}
+
+	if err := m.save("live", "data", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// expired entries are neither returned nor kept by evict
+	m.entries["expired"] = memoryEntry{data: "data", expires: time.Now().Add(-time.Second)}
+
+	if _, err := m.load("expired"); err != errNotFound {
+		t.Errorf("load of expired session: got %v, want errNotFound", err)
+	}
+
+	m.evict()
+
+	if _, ok := m.entries["expired"]; ok {
+		t.Error("expired session not evicted")
+	}
+
+	if got, err := m.load("live"); err != nil || got != "data" {
+		t.Errorf("load of live session: got %q, %v", got, err)
+	}
+
+	if err := m.erase("live"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.load("live"); err != errNotFound {
+		t.Errorf("load of erased session: got %v, want errNotFound", err)
+	}
+}
@@ -0,0 +1,206 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	redisKeyPrefix   = "uaaproxy:session:"
+	redisDialTimeout = 5 * time.Second
+	redisIOTimeout   = 5 * time.Second
+	redisMaxIdle     = 8
+)
+
+// redis is a backend that keeps sessions in a server speaking the Redis
+// protocol. Sessions expire using Redis' built-in key expiry.
+type redis struct {
+	addr     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// NewRedis returns a store that keeps sessions in the Redis database db at
+// the given address. The password is optional.
+func NewRedis(addr, password string, db int, maxAge time.Duration, keyPairs ...[]byte) sessions.Store {
+	return newServerStore(&redis{
+		addr:     addr,
+		password: password,
+		db:       db,
+	}, maxAge, keyPairs...)
+}
+
+func (s *redis) load(id string) (string, error) {
+	reply, err := s.do("GET", redisKeyPrefix+id)
+	if err != nil {
+		return "", err
+	}
+
+	data, ok := reply.(string)
+	if !ok {
+		return "", errNotFound
+	}
+
+	return data, nil
+}
+
+func (s *redis) save(id, data string, ttl time.Duration) error {
+	_, err := s.do("SET", redisKeyPrefix+id, data, "EX", strconv.Itoa(int(ttl.Seconds())))
+	return err
+}
+
+func (s *redis) erase(id string) error {
+	_, err := s.do("DEL", redisKeyPrefix+id)
+	return err
+}
+
+// do sends a command and returns the server's reply. Connections are reused
+// unless an error occurred.
+func (s *redis) do(args ...string) (interface{}, error) {
+	conn, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		conn.Close()
+		return nil, err
+	}
+
+	s.release(conn)
+	return reply, err
+}
+
+func (s *redis) conn() (*redisConn, error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		conn := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return conn, nil
+	}
+	s.mu.Unlock()
+
+	c, err := net.DialTimeout("tcp", s.addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &redisConn{Conn: c, r: bufio.NewReader(c)}
+
+	if s.password != "" {
+		if _, err := conn.do("AUTH", s.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if s.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (s *redis) release(conn *redisConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.idle) >= redisMaxIdle {
+		conn.Close()
+		return
+	}
+
+	s.idle = append(s.idle, conn)
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.SetDeadline(time.Now().Add(redisIOTimeout))
+
+	// commands are sent as array of bulk strings
+	buf := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		buf += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := io.WriteString(c, buf); err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+// readReply parses a single reply, nil bulk strings and arrays are returned
+// as nil.
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed redis reply")
+	}
+
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+
+	return nil, fmt.Errorf("unexpected redis reply type %q", kind)
+}
@@ -0,0 +1,364 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process stand-in for a Redis server supporting the
+// commands used by the redis backend. Time only advances when told to.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	now      time.Time
+	values   map[string]string
+	expires  map[string]time.Time
+	commands [][]string
+	conns    int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeRedis{
+		ln:       ln,
+		password: password,
+		now:      time.Now(),
+		values:   map[string]string{},
+		expires:  map[string]time.Time{},
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.ln.Addr().String()
+}
+
+func (f *fakeRedis) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	f.mu.Lock()
+	f.conns++
+	f.mu.Unlock()
+
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.commands = append(f.commands, args)
+		reply := f.exec(args, &authed)
+		f.mu.Unlock()
+
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) exec(args []string, authed *bool) string {
+	cmd := strings.ToUpper(args[0])
+
+	if cmd == "AUTH" {
+		if len(args) != 2 || args[1] != f.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		*authed = true
+		return "+OK\r\n"
+	}
+
+	if !*authed {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+
+	switch cmd {
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		if exp, ok := f.expires[args[1]]; ok && !f.now.Before(exp) {
+			delete(f.values, args[1])
+			delete(f.expires, args[1])
+		}
+		v, ok := f.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		f.values[args[1]] = args[2]
+		delete(f.expires, args[1])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "EX" {
+			secs, err := strconv.Atoi(args[4])
+			if err != nil || secs <= 0 {
+				return "-ERR invalid expire time in 'set' command\r\n"
+			}
+			f.expires[args[1]] = f.now.Add(time.Duration(secs) * time.Second)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		_, ok := f.values[args[1]]
+		delete(f.values, args[1])
+		delete(f.expires, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+// readCommand parses a command sent as array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+
+	return args, nil
+}
+
+func TestRedisSetGetDelete(t *testing.T) {
+	f := newFakeRedis(t, "")
+	s := &redis{addr: f.addr()}
+
+	if _, err := s.load("missing"); err != errNotFound {
+		t.Fatalf("load of missing session: got %v, want errNotFound", err)
+	}
+
+	// values containing protocol characters must survive the round trip
+	data := "line one\r\nline two $5 *3"
+	if err := s.save("id", data, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.load("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != data {
+		t.Fatalf("load: got %q, want %q", got, data)
+	}
+
+	if err := s.erase("id"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.load("id"); err != errNotFound {
+		t.Fatalf("load after erase: got %v, want errNotFound", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.conns != 1 {
+		t.Errorf("connections: got %d, want 1 reused connection", f.conns)
+	}
+
+	set := f.commands[1]
+	want := []string{"SET", redisKeyPrefix + "id", data, "EX", "60"}
+	if !reflect.DeepEqual(set, want) {
+		t.Errorf("set command: got %q, want %q", set, want)
+	}
+}
+
+func TestRedisExpire(t *testing.T) {
+	f := newFakeRedis(t, "")
+	s := &redis{addr: f.addr()}
+
+	if err := s.save("id", "data", 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	f.advance(29 * time.Second)
+	if _, err := s.load("id"); err != nil {
+		t.Fatalf("load before expiry: %v", err)
+	}
+
+	f.advance(time.Second)
+	if _, err := s.load("id"); err != errNotFound {
+		t.Fatalf("load after expiry: got %v, want errNotFound", err)
+	}
+}
+
+func TestRedisAuthAndSelect(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+
+	s := &redis{addr: f.addr(), password: "secret", db: 2}
+	if err := s.save("id", "data", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	commands := f.commands
+	f.mu.Unlock()
+
+	if got := []string{commands[0][0], commands[1][0], commands[1][1]}; !reflect.DeepEqual(got, []string{"AUTH", "SELECT", "2"}) {
+		t.Errorf("connection setup: got %q", commands[:2])
+	}
+
+	wrong := &redis{addr: f.addr(), password: "wrong"}
+	if _, err := wrong.load("id"); err == nil || !strings.HasPrefix(err.Error(), "WRONGPASS") {
+		t.Errorf("wrong password: got %v, want WRONGPASS error", err)
+	}
+}
+
+func TestRedisErrorReplyKeepsConnection(t *testing.T) {
+	f := newFakeRedis(t, "")
+	s := &redis{addr: f.addr()}
+
+	// the fake rejects non-positive expiry times
+	err := s.save("id", "data", 0)
+	if _, ok := err.(redisError); !ok {
+		t.Fatalf("save: got %v, want redis error reply", err)
+	}
+
+	if err := s.save("id", "data", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conns != 1 {
+		t.Errorf("connections: got %d, want 1", f.conns)
+	}
+}
+
+func TestRedisReadReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  interface{}
+		err   bool
+	}{
+		{"simple string", "+OK\r\n", "OK", false},
+		{"integer", ":42\r\n", int64(42), false},
+		{"bulk string", "$5\r\nhello\r\n", "hello", false},
+		{"empty bulk string", "$0\r\n\r\n", "", false},
+		{"bulk string with crlf", "$4\r\na\r\nb\r\n", "a\r\nb", false},
+		{"nil bulk string", "$-1\r\n", nil, false},
+		{"nil array", "*-1\r\n", nil, false},
+		{"array", "*2\r\n$1\r\na\r\n:1\r\n", []interface{}{"a", int64(1)}, false},
+		{"nested array", "*1\r\n*1\r\n+x\r\n", []interface{}{[]interface{}{"x"}}, false},
+		{"error", "-ERR boom\r\n", nil, true},
+		{"missing cr", "+OK\n", nil, true},
+		{"unknown type", "?x\r\n", nil, true},
+		{"bad integer", ":x\r\n", nil, true},
+		{"truncated bulk string", "$5\r\nhel", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &redisConn{r: bufio.NewReader(strings.NewReader(tt.reply))}
+
+			got, err := conn.readReply()
+			if (err != nil) != tt.err {
+				t.Fatalf("error: got %v, want error %v", err, tt.err)
+			}
+			if !tt.err && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedisStoreRoundTrip(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store := NewRedis(f.addr(), "", 0, time.Hour, []byte("hash-key"), []byte("block-key-16byte"))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	session, err := store.New(req, "uaaproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["token"] = strings.Repeat("t", 10000)
+
+	rec := httptest.NewRecorder()
+	if err := session.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+
+	loaded, err := store.New(req, "uaaproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.IsNew || loaded.Values["token"] != session.Values["token"] {
+		t.Fatalf("session not restored from redis")
+	}
+
+	// deleting the session erases it in redis
+	loaded.Options.MaxAge = -1
+	if err := loaded.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.New(req, "uaaproxy"); err != errNotFound {
+		t.Fatalf("load of deleted session: got %v, want errNotFound", err)
+	}
+}
@@ -0,0 +1,166 @@
+// Package store provides the session stores the proxy can keep its sessions
+// in. All stores authenticate and encrypt session data using secure cookie
+// codecs.
+package store
+
+import (
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// errNotFound is returned by backends for unknown or expired sessions
+var errNotFound = errors.New("session not found")
+
+// Keys returns the key pair used to authenticate and encrypt sessions. A
+// missing hash key is generated randomly, the block key is adjusted to a
+// valid AES key size.
+func Keys(hashKey, blockKey []byte) ([]byte, []byte) {
+	if len(hashKey) == 0 {
+		hashKey = securecookie.GenerateRandomKey(64)
+	}
+
+	return hashKey, adjustBlockKey(blockKey)
+}
+
+// blockKey must either be 32-, 24-, or 16-byte long
+func adjustBlockKey(key []byte) []byte {
+	if len(key) > 32 {
+		key = key[:32]
+	}
+
+	if l := len(key); l < 32 && l > 24 {
+		key = key[:24]
+	}
+
+	if l := len(key); l < 32 && l > 16 {
+		key = key[:16]
+	}
+
+	if len(key) < 16 {
+		key = securecookie.GenerateRandomKey(32)
+	}
+
+	return key
+}
+
+// codecs returns secure cookie codecs for the given key pairs. Session data
+// kept on the server side is not limited by the maximum cookie size.
+func codecs(maxAge time.Duration, keyPairs ...[]byte) []securecookie.Codec {
+	cs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, c := range cs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(int(maxAge.Seconds()))
+			sc.MaxLength(0)
+		}
+	}
+	return cs
+}
+
+// backend persists encoded session data under a given session id.
+type backend interface {
+	load(id string) (string, error)
+	save(id, data string, ttl time.Duration) error
+	erase(id string) error
+}
+
+// serverStore keeps session data in a backend, the cookie only contains the
+// encoded session id.
+type serverStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	backend backend
+}
+
+func newServerStore(b backend, maxAge time.Duration, keyPairs ...[]byte) *serverStore {
+	return &serverStore{
+		Codecs: codecs(maxAge, keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: int(maxAge.Seconds()),
+		},
+		backend: b,
+	}
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (s *serverStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+func (s *serverStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		// no cookie, no session
+		return session, nil
+	}
+
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...); err != nil {
+		return session, err
+	}
+
+	data, err := s.backend.load(session.ID)
+	if err != nil {
+		return session, err
+	}
+
+	if err := securecookie.DecodeMulti(name, data, &session.Values, s.Codecs...); err != nil {
+		return session, err
+	}
+
+	session.IsNew = false
+	return session, nil
+}
+
+// Save persists the session in the backend and sets the session cookie. If
+// the session's MaxAge is <= 0 the session gets erased.
+func (s *serverStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if err := s.backend.erase(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = newSessionID()
+	}
+
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if err := s.backend.save(session.ID, data, ttl); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// session ids only contain alphanumeric characters to be safe for use in
+// file names and backend keys
+func newSessionID() string {
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+}
@@ -0,0 +1,60 @@
+package uaa
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/st3v/uaa-proxy/logging"
+
+	"golang.org/x/oauth2"
+)
+
+// User describes the authenticated user based on the claims of the tokens
+// issued by UAA.
+type User struct {
+	ID     string
+	Name   string
+	Email  string
+	Origin string
+	Scopes []string
+}
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	tokenContextKey
+	clientCertContextKey
+)
+
+// UserFromContext returns the authenticated user stored in the request
+// context by the Authorize handler.
+func UserFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userContextKey).(*User)
+	return user, ok
+}
+
+// AccessTokenFromContext returns the access token of the authenticated user
+// stored in the request context by the Authorize handler.
+func AccessTokenFromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(tokenContextKey).(string)
+	return token, ok && token != ""
+}
+
+func withIdentity(r *http.Request, user *User, token *oauth2.Token) *http.Request {
+	logging.SetUserID(r.Context(), user.ID)
+
+	ctx := context.WithValue(r.Context(), tokenContextKey, token.AccessToken)
+	ctx = context.WithValue(ctx, userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+func userFromClaims(claims Claims) *User {
+	return &User{
+		ID:     claims.String("user_id"),
+		Name:   claims.String("user_name"),
+		Email:  claims.String("email"),
+		Origin: claims.String("origin"),
+		Scopes: claims.Scopes(),
+	}
+}
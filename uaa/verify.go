@@ -0,0 +1,100 @@
+package uaa
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Claims holds the verified claims of a token issued by UAA.
+type Claims map[string]interface{}
+
+// String returns the string claim for a given key, or an empty string if the
+// claim is missing or not a string.
+func (c Claims) String(key string) string {
+	s, _ := c[key].(string)
+	return s
+}
+
+// Strings returns a claim that is either a single string or a list of strings.
+func (c Claims) Strings(key string) []string {
+	switch v := c[key].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		strs := make([]string, 0, len(v))
+		for _, s := range v {
+			if str, ok := s.(string); ok {
+				strs = append(strs, str)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
+// Scopes returns the scopes granted by a token.
+func (c Claims) Scopes() []string {
+	return c.Strings("scope")
+}
+
+// TokenVerifier verifies the signature and the claims of tokens issued by UAA.
+type TokenVerifier struct {
+	keys     *keySet
+	issuer   string
+	audience string
+	zoneID   string
+}
+
+// NewTokenVerifier returns a verifier that validates token signatures against
+// the keys published by UAA at keysURL. Empty issuer, audience or zoneID
+// values disable the corresponding claim check.
+func NewTokenVerifier(keysURL, issuer, audience, zoneID string, httpClient *http.Client) *TokenVerifier {
+	return &TokenVerifier{
+		keys:     newKeySet(keysURL, httpClient),
+		issuer:   issuer,
+		audience: audience,
+		zoneID:   zoneID,
+	}
+}
+
+// Verify parses a raw JWT and returns its claims if the signature is valid,
+// the token has not expired and the iss, aud and zid claims match.
+func (v *TokenVerifier) Verify(raw string) (Claims, error) {
+	token, err := jwt.Parse(raw, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method {
+		case jwt.SigningMethodRS256, jwt.SigningMethodRS384, jwt.SigningMethodRS512:
+		default:
+			return nil, fmt.Errorf("unexpected signing method %q", t.Header["alg"])
+		}
+
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.key(kid)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	claims := Claims(token.Claims)
+
+	if _, ok := claims["exp"].(float64); !ok {
+		return nil, errors.New("token has no expiry")
+	}
+
+	if v.issuer != "" && claims.String("iss") != v.issuer {
+		return nil, fmt.Errorf("invalid issuer %q", claims.String("iss"))
+	}
+
+	if v.audience != "" && !contains(claims.Strings("aud"), v.audience) {
+		return nil, fmt.Errorf("token not intended for audience %q", v.audience)
+	}
+
+	if v.zoneID != "" && claims.String("zid") != v.zoneID {
+		return nil, fmt.Errorf("invalid zone %q", claims.String("zid"))
+	}
+
+	return claims, nil
+}
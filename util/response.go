@@ -0,0 +1,74 @@
+package util
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// ResponseRecorder remembers the status code and the number of bytes written
+// by a handler. It supports hijacking and flushing, required by the websocket
+// and HTTP proxy.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	code     int
+	bytes    int64
+	hijacked bool
+}
+
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w}
+}
+
+func (r *ResponseRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *ResponseRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *ResponseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	conn, buf, err := hj.Hijack()
+	if err == nil {
+		r.hijacked = true
+	}
+	return conn, buf, err
+}
+
+// Status returns the status code sent to the client, hijacked connections
+// are reported as switching protocols.
+func (r *ResponseRecorder) Status() int {
+	switch {
+	case r.hijacked:
+		return http.StatusSwitchingProtocols
+	case r.code == 0:
+		return http.StatusOK
+	default:
+		return r.code
+	}
+}
+
+// Bytes returns the number of bytes of the response body.
+func (r *ResponseRecorder) Bytes() int64 {
+	return r.bytes
+}